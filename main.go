@@ -103,6 +103,10 @@ func (s *WebServer) Run() error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcile(os.Args[2:]))
+	}
+
 	server := NewWebServer("0.0.0.0:9080", false)
 	log.SetOutput(server.LogWriter)
 	if err := server.Run(); err != nil {
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"home_api/src/api/modules/familytree"
+	"home_api/src/api/modules/photodump"
+	"home_api/src/api/modules/tags"
+	"home_api/src/database"
+	"log"
+	"os"
+
+	"github.com/goccy/go-json"
+)
+
+// reconcile - Compare the photos bucket with the photos table, printing a report and repairing it with -repair
+func reconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair what's found instead of only reporting it")
+	flags.Parse(args)
+
+	ts := tags.NewService(tags.NewStore(database.GetDB("home")))
+	fs := familytree.NewStore(database.GetDB("home"))
+	s := photodump.NewService(photodump.NewStore(database.GetDB("home"), database.GetS3()), ts, fs)
+	report, _, err := s.Reconcile(*repair)
+	if err != nil {
+		log.Println("could not reconcile photos", err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Println("could not print report", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+CREATE TABLE familytree (
+    id BIGINT PRIMARY KEY NOT NULL,
+    name TEXT NOT NULL,
+    middle_names TEXT[],
+    surname TEXT,
+    nicknames TEXT[],
+    sex TEXT,
+    gender TEXT,
+    pronouns TEXT,
+    dob BIGINT,
+    dod BIGINT,
+    parents BIGINT[],
+    step_parents BIGINT[],
+    guardians BIGINT[],
+    is_adopted BOOLEAN,
+    partner BIGINT,
+    prev_partners BIGINT[]
+);
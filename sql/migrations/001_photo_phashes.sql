@@ -0,0 +1,2 @@
+-- Perceptual hashes of every rotation/flip of a photo, used for duplicate detection
+ALTER TABLE photos ADD COLUMN phashes BYTEA[];
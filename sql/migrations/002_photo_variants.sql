@@ -0,0 +1,2 @@
+-- Photos uploaded with the link-as-variant duplicate policy point at the photo they're a copy of
+ALTER TABLE photos ADD COLUMN variant_of TEXT REFERENCES photos(id) ON DELETE SET NULL;
@@ -0,0 +1,2 @@
+-- Resized WebP copies of each photo, as a list of {"width", "height", "file"} objects
+ALTER TABLE photos ADD COLUMN derivatives JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,16 @@
+-- Background processing queue for photos
+CREATE TABLE photo_jobs (
+    id TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 5,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_jobs_photo_id_idx ON photo_jobs (photo_id);
+CREATE INDEX photo_jobs_due_idx ON photo_jobs (run_at) WHERE status IN ('pending', 'running');
@@ -0,0 +1,2 @@
+-- A full size copy of HEIC/HEIF and AVIF photos in a format browsers can display
+ALTER TABLE photos ADD COLUMN rendition TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,17 @@
+-- Camera, exposure and location details extracted from EXIF/IPTC/XMP, along with the raw tags
+ALTER TABLE photos
+    ADD COLUMN camera_make TEXT NOT NULL DEFAULT '',
+    ADD COLUMN camera_model TEXT NOT NULL DEFAULT '',
+    ADD COLUMN lens TEXT NOT NULL DEFAULT '',
+    ADD COLUMN exposure_time TEXT NOT NULL DEFAULT '',
+    ADD COLUMN f_number DOUBLE PRECISION,
+    ADD COLUMN iso INT,
+    ADD COLUMN focal_length DOUBLE PRECISION,
+    ADD COLUMN orientation INT NOT NULL DEFAULT 1,
+    ADD COLUMN latitude DOUBLE PRECISION,
+    ADD COLUMN longitude DOUBLE PRECISION,
+    ADD COLUMN keywords TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX photos_camera_idx ON photos (camera_make, camera_model);
+
@@ -0,0 +1,4 @@
+-- Where taken_at came from, and the UTC offset in seconds the photo was taken in
+ALTER TABLE photos
+    ADD COLUMN taken_at_source TEXT NOT NULL DEFAULT 'filesystem',
+    ADD COLUMN taken_at_offset INT;
@@ -0,0 +1,2 @@
+-- Speeds up the near and bounding box queries, which filter on latitude first
+CREATE INDEX photos_location_idx ON photos (latitude, longitude) WHERE latitude IS NOT NULL;
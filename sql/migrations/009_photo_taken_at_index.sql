@@ -0,0 +1,2 @@
+-- Keyset pagination orders photos by (taken_at, id)
+CREATE INDEX photos_taken_at_idx ON photos (taken_at DESC, id DESC);
@@ -0,0 +1,4 @@
+-- Photo search can sort by upload time, and filters on tags and subjects with @>
+CREATE INDEX photos_uploaded_at_idx ON photos (uploaded_at DESC, id DESC);
+CREATE INDEX photos_tags_idx ON photos USING GIN (tags);
+CREATE INDEX photos_subjects_idx ON photos USING GIN (subjects);
@@ -0,0 +1,15 @@
+-- The text that photos are searched by, weighted so descriptions count the most.
+-- array_to_string isn't immutable, so generated columns need it wrapped in a function that is.
+CREATE FUNCTION photo_search_vector(_description TEXT, _subjects TEXT[], _tags TEXT[], _source TEXT) RETURNS TSVECTOR
+AS $$
+  SELECT setweight(to_tsvector('english', coalesce(_description, '')), 'A') ||
+         setweight(to_tsvector('english', coalesce(array_to_string(_subjects, ' '), '')), 'B') ||
+         setweight(to_tsvector('english', coalesce(array_to_string(_tags, ' '), '')), 'B') ||
+         setweight(to_tsvector('english', coalesce(_source, '')), 'C')
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- Adding a stored generated column rewrites the table, which fills it in for existing photos
+ALTER TABLE photos
+    ADD COLUMN search TSVECTOR GENERATED ALWAYS AS (photo_search_vector(description, subjects, tags, source)) STORED;
+
+CREATE INDEX photos_search_idx ON photos USING GIN (search);
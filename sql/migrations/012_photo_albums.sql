@@ -0,0 +1,21 @@
+-- Albums are hand ordered collections of photos, a photo can be in any number of them
+CREATE TABLE albums (
+    id TEXT NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    cover_photo_id TEXT REFERENCES photos(id) ON DELETE SET NULL,
+    position INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE album_photos (
+    album_id TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    photo_id TEXT NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    added_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (album_id, photo_id)
+);
+
+CREATE INDEX album_photos_position_idx ON album_photos (album_id, position);
+CREATE INDEX album_photos_photo_id_idx ON album_photos (photo_id);
@@ -0,0 +1,9 @@
+-- Smart albums save a photo search as JSON, and are resolved whenever their photos are asked for
+CREATE TABLE smart_albums (
+    id TEXT NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    query JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,21 @@
+-- The shared tag vocabulary for photos and wool, replacing the hard coded sparkly and christmas tags.
+-- Every tag that's already on a photo is added, so existing photos keep validating.
+CREATE TABLE tags (
+    name TEXT NOT NULL PRIMARY KEY,
+    colour TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    aliases TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX tags_aliases_idx ON tags USING GIN (aliases);
+
+INSERT INTO tags (name, created_at, modified_at)
+SELECT tag, NOW(), NOW() FROM (
+    SELECT 'sparkly' AS tag
+    UNION SELECT 'christmas'
+    UNION SELECT DISTINCT LOWER(TRIM(UNNEST(tags))) FROM photos
+) AS existing
+WHERE tag <> ''
+ON CONFLICT DO NOTHING;
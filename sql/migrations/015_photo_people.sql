@@ -0,0 +1,5 @@
+-- Subjects that name someone in the family tree are linked by their person ID,
+-- anyone who can't be linked stays in the free text subjects
+ALTER TABLE photos ADD COLUMN people BIGINT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX photos_people_idx ON photos USING GIN (people);
@@ -0,0 +1,9 @@
+-- Labelled rectangles on photos, eg. faces, normalized to the upright image.
+-- Existing photos get the regions from their files by queueing a metadata job for each of them,
+-- which keeps any time that was set by hand.
+ALTER TABLE photos ADD COLUMN regions JSONB NOT NULL DEFAULT '[]';
+
+INSERT INTO photo_jobs (id, photo_id, kind, status, attempts, max_attempts, last_error, run_at, created_at, updated_at)
+SELECT 'regions-' || id, id, 'metadata', 'pending', 0, 5, '', NOW(), NOW(), NOW()
+FROM photos
+ON CONFLICT (id) DO NOTHING;
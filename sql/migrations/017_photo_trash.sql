@@ -0,0 +1,4 @@
+-- Deleted photos go to the trash first, and are purged once they've been there for the retention period
+ALTER TABLE photos ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX photos_deleted_at_idx ON photos (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Objects in the photos bucket waiting to be deleted, queued in the same statement that stops a row needing them.
+-- Uploads queue their object before writing it and cancel it once the row is saved, so a crash can't leave an orphan.
+-- Run `./home_api reconcile` once after migrating to find anything left over from before.
+CREATE TABLE photo_outbox (
+    object TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    claimed BOOLEAN NOT NULL DEFAULT FALSE,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_outbox_run_at_idx ON photo_outbox (run_at);
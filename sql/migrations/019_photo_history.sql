@@ -0,0 +1,13 @@
+-- Who changed what on a photo, with each edited field before and after, so edits can be reverted.
+-- The history is an audit trail, so it's kept when a photo is purged from the trash,
+-- photo_id staying as the ID of the photo that was purged.
+CREATE TABLE photo_history (
+    id TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    changes JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_history_photo_id_idx ON photo_history (photo_id, created_at DESC);
@@ -1,9 +1,20 @@
+-- The text that photos are searched by, weighted so descriptions count the most.
+-- array_to_string isn't immutable, so generated columns need it wrapped in a function that is.
+CREATE FUNCTION photo_search_vector(_description TEXT, _subjects TEXT[], _tags TEXT[], _source TEXT) RETURNS TSVECTOR
+AS $$
+  SELECT setweight(to_tsvector('english', coalesce(_description, '')), 'A') ||
+         setweight(to_tsvector('english', coalesce(array_to_string(_subjects, ' '), '')), 'B') ||
+         setweight(to_tsvector('english', coalesce(array_to_string(_tags, ' '), '')), 'B') ||
+         setweight(to_tsvector('english', coalesce(_source, '')), 'C')
+$$ LANGUAGE SQL IMMUTABLE;
+
 CREATE TABLE photos (
     id TEXT NOT NULL PRIMARY KEY,
     file TEXT NOT NULL,
     ext TEXT NOT NULL,
     hash TEXT NOT NULL,
     phash BYTEA NOT NULL,
+    phashes BYTEA[],
     description TEXT,
     source TEXT,
     subjects TEXT[],
@@ -11,6 +22,106 @@ CREATE TABLE photos (
     resolution TEXT,
     taken_at TIMESTAMP WITH TIME ZONE,
     uploaded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    variant_of TEXT REFERENCES photos(id) ON DELETE SET NULL,
+    derivatives JSONB NOT NULL DEFAULT '[]',
+    rendition TEXT NOT NULL DEFAULT '',
+    camera_make TEXT NOT NULL DEFAULT '',
+    camera_model TEXT NOT NULL DEFAULT '',
+    lens TEXT NOT NULL DEFAULT '',
+    exposure_time TEXT NOT NULL DEFAULT '',
+    f_number DOUBLE PRECISION,
+    iso INT,
+    focal_length DOUBLE PRECISION,
+    orientation INT NOT NULL DEFAULT 1,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    keywords TEXT[] NOT NULL DEFAULT '{}',
+    metadata JSONB NOT NULL DEFAULT '{}',
+    taken_at_source TEXT NOT NULL DEFAULT 'filesystem',
+    taken_at_offset INT,
+    people BIGINT[] NOT NULL DEFAULT '{}',
+    regions JSONB NOT NULL DEFAULT '[]',
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    search TSVECTOR GENERATED ALWAYS AS (photo_search_vector(description, subjects, tags, source)) STORED
+);
+
+CREATE INDEX photos_taken_at_idx ON photos (taken_at DESC, id DESC);
+CREATE INDEX photos_uploaded_at_idx ON photos (uploaded_at DESC, id DESC);
+CREATE INDEX photos_tags_idx ON photos USING GIN (tags);
+CREATE INDEX photos_subjects_idx ON photos USING GIN (subjects);
+CREATE INDEX photos_people_idx ON photos USING GIN (people);
+CREATE INDEX photos_search_idx ON photos USING GIN (search);
+CREATE INDEX photos_camera_idx ON photos (camera_make, camera_model);
+CREATE INDEX photos_location_idx ON photos (latitude, longitude) WHERE latitude IS NOT NULL;
+CREATE INDEX photos_deleted_at_idx ON photos (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE photo_jobs (
+    id TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 5,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_jobs_photo_id_idx ON photo_jobs (photo_id);
+CREATE INDEX photo_jobs_due_idx ON photo_jobs (run_at) WHERE status IN ('pending', 'running');
+
+CREATE TABLE photo_outbox (
+    object TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    claimed BOOLEAN NOT NULL DEFAULT FALSE,
+    last_error TEXT NOT NULL DEFAULT '',
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_outbox_run_at_idx ON photo_outbox (run_at);
+
+CREATE TABLE photo_history (
+    id TEXT NOT NULL PRIMARY KEY,
+    photo_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL DEFAULT '',
+    changes JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX photo_history_photo_id_idx ON photo_history (photo_id, created_at DESC);
+
+CREATE TABLE albums (
+    id TEXT NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    cover_photo_id TEXT REFERENCES photos(id) ON DELETE SET NULL,
+    position INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE album_photos (
+    album_id TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    photo_id TEXT NOT NULL REFERENCES photos(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    added_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (album_id, photo_id)
+);
+
+CREATE INDEX album_photos_position_idx ON album_photos (album_id, position);
+CREATE INDEX album_photos_photo_id_idx ON album_photos (photo_id);
+
+CREATE TABLE smart_albums (
+    id TEXT NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    query JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
     modified_at TIMESTAMP WITH TIME ZONE NOT NULL
 );
 
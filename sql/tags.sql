@@ -0,0 +1,14 @@
+CREATE TABLE tags (
+    name TEXT NOT NULL PRIMARY KEY,
+    colour TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    aliases TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX tags_aliases_idx ON tags USING GIN (aliases);
+
+INSERT INTO tags (name, created_at, modified_at) VALUES
+    ('sparkly', NOW(), NOW()),
+    ('christmas', NOW(), NOW());
@@ -2,6 +2,14 @@ package familytree
 
 import (
 	"context"
+	"errors"
+	"home_api/src/responses"
+	"home_api/src/web"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -26,22 +34,23 @@ import (
 //  prev_partners BIGINT[]
 // );
 
+// Person Someone in the family tree, everything but their ID and name can be NULL
 type Person struct {
 	ID           int64    `json:"id" db:"id"`
 	Name         string   `json:"name" db:"name"`
 	MiddleNames  []string `json:"middle_names" db:"middle_names"`
-	Surname      string   `json:"surname" db:"surname"`
+	Surname      *string  `json:"surname" db:"surname"`
 	Nicknames    []string `json:"nicknames" db:"nicknames"`
-	Sex          string   `json:"sex" db:"sex"`
-	Gender       string   `json:"gender" db:"gender"`
-	Pronouns     string   `json:"pronouns" db:"pronouns"`
-	DOB          int64    `json:"dob" db:"dob"`
-	DOD          int64    `json:"dod" db:"dod"`
+	Sex          *string  `json:"sex" db:"sex"`
+	Gender       *string  `json:"gender" db:"gender"`
+	Pronouns     *string  `json:"pronouns" db:"pronouns"`
+	DOB          *int64   `json:"dob" db:"dob"`
+	DOD          *int64   `json:"dod" db:"dod"`
 	Parents      []int64  `json:"parents" db:"parents"`
 	StepParents  []int64  `json:"step_parents" db:"step_parents"`
 	Guardians    []int64  `json:"guardians" db:"guardians"`
-	IsAdopted    bool     `json:"is_adopted" db:"is_adopted"`
-	Partner      int64    `json:"partner" db:"partner"`
+	IsAdopted    *bool    `json:"is_adopted" db:"is_adopted"`
+	Partner      *int64   `json:"partner" db:"partner"`
 	PrevPartners []int64  `json:"prev_partners" db:"prev_partners"`
 }
 
@@ -56,7 +65,7 @@ func NewStore(db *pgxpool.Pool) *Store {
 func (s *Store) GetPerson(id int64) (*Person, error) {
 	var person *Person
 
-	rows, err := s.db.Query(context.Background(), "SELECT * FROM sessions WHERE id = $1", id)
+	rows, err := s.db.Query(context.Background(), "SELECT * FROM familytree WHERE id = $1", id)
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +81,7 @@ func (s *Store) GetPerson(id int64) (*Person, error) {
 func (s *Store) GetPersonByName(name string) (*Person, error) {
 	var person *Person
 
-	rows, err := s.db.Query(context.Background(), "SELECT * FROM sessions WHERE name = $1", name)
+	rows, err := s.db.Query(context.Background(), "SELECT * FROM familytree WHERE name = $1", name)
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +98,7 @@ func (s *Store) GetPersonByFullName(name, middleName, surname string) (*Person,
 	var person *Person
 
 	rows, err := s.db.Query(context.Background(),
-		"SELECT * FROM sessions WHERE name = $1 AND $2 IN (middle_names) AND surname = $3",
+		"SELECT * FROM familytree WHERE name = $1 AND $2 IN (middle_names) AND surname = $3",
 		name, middleName, surname)
 	if err != nil {
 		return nil, err
@@ -112,3 +121,113 @@ func (s *Store) CreatePerson(person *Person) error {
 	}
 	return nil
 }
+
+func (s *Store) GetPeople() ([]*Person, error) {
+	rows, err := s.db.Query(context.Background(), "SELECT * FROM familytree")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Person])
+}
+
+// FullName The person's name, middle names and surname
+func (p *Person) FullName() string {
+	return strings.Join(slices.DeleteFunc(append(append([]string{p.Name}, p.MiddleNames...), p.surname()),
+		func(name string) bool { return name == "" }), " ")
+}
+
+// surname The person's surname, or empty if they don't have one
+func (p *Person) surname() string {
+	if p.Surname == nil {
+		return ""
+	}
+	return *p.Surname
+}
+
+// Names Every way the person might be written down, normalized with NormalizeName
+func (p *Person) Names() []string {
+	var names []string
+	for _, first := range append([]string{p.Name}, p.Nicknames...) {
+		if first == "" {
+			continue
+		}
+		names = append(names, first)
+		if p.surname() != "" {
+			names = append(names, first+" "+p.surname())
+		}
+	}
+	names = append(names, p.FullName())
+	for i, name := range names {
+		names[i] = NormalizeName(name)
+	}
+	return names
+}
+
+// NormalizeName Lower case a name and collapse its whitespace, so names can be compared
+func NormalizeName(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// MatchPeople Find the person each name refers to. Names that could be more than one person,
+// or no one at all, are left out.
+func MatchPeople(people []*Person, names []string) map[string]int64 {
+	candidates := make(map[string][]int64)
+	for _, person := range people {
+		for _, name := range person.Names() {
+			if !slices.Contains(candidates[name], person.ID) {
+				candidates[name] = append(candidates[name], person.ID)
+			}
+		}
+	}
+	matches := make(map[string]int64)
+	for _, name := range names {
+		if ids := candidates[NormalizeName(name)]; len(ids) == 1 {
+			matches[name] = ids[0]
+		}
+	}
+	return matches
+}
+
+// GetPerson Get a person by the ID in the path
+func GetPerson(s *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		person, err := getPersonFromPath(s, w, r)
+		if err != nil {
+			return
+		}
+		responses.StructOK(w, r, person)
+	}
+}
+
+// GetPersonHTML Render the person view for the person in the path
+func GetPersonHTML(s *Store, cw web.FuncWrapper[*Person]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		person, err := getPersonFromPath(s, w, r)
+		if err != nil {
+			return
+		}
+		responses.SendComponent(w, r, cw(person))
+	}
+}
+
+// getPersonFromPath Get the person with the ID in the path, sending an error response if that fails
+func getPersonFromPath(s *Store, w http.ResponseWriter, r *http.Request) (*Person, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		responses.BadRequest(w, r, "invalid person ID")
+		return nil, err
+	}
+	person, err := s.GetPerson(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		responses.NotFound(w, r, "person does not exist")
+		return nil, err
+	}
+	if err != nil {
+		log.Println("could not get person. ID: "+r.PathValue("id"), err)
+		responses.InternalServerError(w, r, "could not get person")
+		return nil, err
+	}
+	return person, nil
+}
@@ -0,0 +1,630 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/database"
+	"home_api/src/responses"
+	"home_api/src/web"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// Album A named, hand ordered collection of photos. A photo can be in any number of albums.
+type Album struct {
+	ID           string    `json:"id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	Description  string    `json:"description" db:"description"`
+	CoverPhotoID *string   `json:"cover_photo_id" db:"cover_photo_id"`
+	Position     int       `json:"position" db:"position"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ModifiedAt   time.Time `json:"modified_at" db:"modified_at"`
+
+	// PhotoCount and Cover are worked out when the album is read, they're never stored
+	PhotoCount int    `json:"photo_count" db:"photo_count"`
+	Cover      string `json:"cover" db:"cover"`
+}
+
+// AlbumView An album along with its photos, in the album's order
+type AlbumView struct {
+	Album  *Album   `json:"album"`
+	Photos []*Photo `json:"photos"`
+}
+
+// AlbumsPage Every album, along with the album that's open if there is one
+type AlbumsPage struct {
+	Albums []*Album
+	Open   *AlbumView
+}
+
+// IDList A list of IDs, used to add photos to an album and to set the order of albums and photos
+type IDList struct {
+	IDs []string `json:"ids"`
+}
+
+// ------------------- Store -------------------
+
+// selectAlbumsQuery The cover is the thumbnail of the chosen cover photo, or of the first photo if none was chosen
+const selectAlbumsQuery = `
+SELECT albums.*,
+	(SELECT COUNT(*) FROM album_photos
+		JOIN photos ON photos.id = album_photos.photo_id
+		WHERE album_id = albums.id AND deleted_at IS NULL) AS photo_count,
+	COALESCE((
+		SELECT COALESCE(derivatives->0->>'file', NULLIF(rendition, ''), file) FROM photos
+		WHERE deleted_at IS NULL AND id = COALESCE(albums.cover_photo_id, (
+			SELECT photo_id FROM album_photos
+			JOIN photos ON photos.id = album_photos.photo_id
+			WHERE album_id = albums.id AND deleted_at IS NULL
+			ORDER BY position, added_at LIMIT 1))
+	), '') AS cover
+FROM albums`
+
+// GetAlbums Get every album, in order
+func (s *store) GetAlbums() ([]*Album, error) {
+	rows, err := s.db.Query(context.Background(), selectAlbumsQuery+" ORDER BY position, created_at")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Album])
+}
+
+// GetAlbumById Get the specified Album from the database
+func (s *store) GetAlbumById(id string) (*Album, error) {
+	rows, _ := s.db.Query(context.Background(), selectAlbumsQuery+" WHERE albums.id = $1", id)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[Album])
+}
+
+// CreateAlbum Add an Album to the end of the list of albums
+func (s *store) CreateAlbum(a *Album) error {
+	err := s.db.QueryRow(context.Background(), `
+INSERT INTO albums (id, name, description, cover_photo_id, position, created_at, modified_at)
+VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(position), 0) + 1 FROM albums), $5, $6)
+RETURNING position`,
+		a.ID, a.Name, a.Description, a.CoverPhotoID, a.CreatedAt, a.ModifiedAt).Scan(&a.Position)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateAlbum Update the name, description and cover of an Album in the database
+func (s *store) UpdateAlbum(a *Album) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE albums SET name = $2, description = $3, cover_photo_id = $4, modified_at = $5 WHERE id = $1",
+		a.ID, a.Name, a.Description, a.CoverPhotoID, a.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteAlbum Delete an Album from the database, the photos in it are kept
+func (s *store) DeleteAlbum(id string) error {
+	_, err := s.db.Exec(context.Background(), "DELETE FROM albums WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReorderAlbums Set the position of each album to its index in ids
+func (s *store) ReorderAlbums(ids []string) error {
+	_, err := s.db.Exec(context.Background(), `
+UPDATE albums SET position = o.position
+FROM UNNEST($1::TEXT[]) WITH ORDINALITY AS o(id, position)
+WHERE albums.id = o.id`, ids)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetAlbumPhotos Get the photos in an album, in order
+func (s *store) GetAlbumPhotos(id string) ([]*Photo, error) {
+	rows, err := s.db.Query(context.Background(), `
+SELECT `+photoColumns+` FROM album_photos
+JOIN photos ON photos.id = album_photos.photo_id
+WHERE album_photos.album_id = $1 AND photos.deleted_at IS NULL
+ORDER BY album_photos.position, album_photos.added_at`, id)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+// addAlbumPhotosQuery Appends the photos in the given order, skipping ones that don't exist or are already in the album
+const addAlbumPhotosQuery = `
+WITH added AS (
+	INSERT INTO album_photos (album_id, photo_id, position, added_at)
+	SELECT $1, photos.id, (SELECT COALESCE(MAX(position), 0) FROM album_photos WHERE album_id = $1) + o.position, NOW()
+	FROM UNNEST($2::TEXT[]) WITH ORDINALITY AS o(photo_id, position)
+	JOIN photos ON photos.id = o.photo_id AND photos.deleted_at IS NULL
+	ON CONFLICT DO NOTHING
+	RETURNING photo_id
+), touched AS (
+	UPDATE albums SET modified_at = NOW()
+	WHERE id = $1 AND EXISTS (SELECT 1 FROM added)
+)
+SELECT COUNT(*) FROM added`
+
+// AddAlbumPhotos Add photos to the end of an album, returning how many were added
+func (s *store) AddAlbumPhotos(id string, photoIDs []string) (int64, error) {
+	var added int64
+	err := s.db.QueryRow(context.Background(), addAlbumPhotosQuery, id, photoIDs).Scan(&added)
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// removeAlbumPhotoQuery Also unsets the cover if it was the photo that was removed
+const removeAlbumPhotoQuery = `
+WITH removed AS (
+	DELETE FROM album_photos WHERE album_id = $1 AND photo_id = $2
+	RETURNING album_id
+)
+UPDATE albums SET modified_at = NOW(),
+	cover_photo_id = CASE WHEN cover_photo_id = $2 THEN NULL ELSE cover_photo_id END
+WHERE id IN (SELECT album_id FROM removed)`
+
+// RemoveAlbumPhoto Remove a photo from an album, returning how many were removed
+func (s *store) RemoveAlbumPhoto(id string, photoID string) (int64, error) {
+	tag, err := s.db.Exec(context.Background(), removeAlbumPhotoQuery, id, photoID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ReorderAlbumPhotos Set the position of each photo in an album to its index in photoIDs
+func (s *store) ReorderAlbumPhotos(id string, photoIDs []string) error {
+	_, err := s.db.Exec(context.Background(), `
+WITH reordered AS (
+	UPDATE album_photos SET position = o.position
+	FROM UNNEST($2::TEXT[]) WITH ORDINALITY AS o(photo_id, position)
+	WHERE album_photos.album_id = $1 AND album_photos.photo_id = o.photo_id
+)
+UPDATE albums SET modified_at = NOW() WHERE id = $1`, id, photoIDs)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// HasAlbumPhoto Whether a photo is in an album
+func (s *store) HasAlbumPhoto(id string, photoID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM album_photos WHERE album_id = $1 AND photo_id = $2)",
+		id, photoID).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// ------------------- Service -------------------
+
+// GetAlbums Get every album, in order
+func (s *service) GetAlbums() ([]*Album, int, error) {
+	albums, err := s.ps.GetAlbums()
+	if err != nil {
+		log.Println("could not get albums", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get albums")
+	}
+	return albums, http.StatusOK, nil
+}
+
+// GetAlbumById Get the specified Album from the database
+func (s *service) GetAlbumById(id string) (*Album, int, error) {
+	album, err := s.ps.GetAlbumById(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("album does not exist")
+	}
+	if err != nil {
+		log.Println("could not get album. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get album")
+	}
+	return album, http.StatusOK, nil
+}
+
+// CreateAlbum Create a new, empty Album at the end of the list of albums
+func (s *service) CreateAlbum(album *Album) (int, error) {
+	album.Name = strings.TrimSpace(album.Name)
+	if album.Name == "" {
+		return http.StatusBadRequest, errors.New("album needs a name")
+	}
+	if album.CoverPhotoID != nil {
+		return http.StatusBadRequest, errors.New("a new album has no photos to use as the cover")
+	}
+	id, err := database.GenSnowflake()
+	if err != nil {
+		log.Println("could not generate id", err)
+		return http.StatusInternalServerError, errors.New("could not generate id")
+	}
+	album.ID = id
+	album.CreatedAt = time.Now()
+	album.ModifiedAt = album.CreatedAt
+	album.PhotoCount = 0
+	album.Cover = ""
+	err = s.ps.CreateAlbum(album)
+	if err != nil {
+		log.Println("could not create album", err)
+		return http.StatusInternalServerError, errors.New("could not create album")
+	}
+	log.Println("created album. ID: " + album.ID)
+	return http.StatusCreated, nil
+}
+
+// EditAlbum Rename an album, or change its description or cover photo. The cover has to be in the album.
+func (s *service) EditAlbum(edit *Album) (*Album, int, error) {
+	album, status, err := s.GetAlbumById(edit.ID)
+	if err != nil {
+		return nil, status, err
+	}
+	edit.Name = strings.TrimSpace(edit.Name)
+	if edit.Name == "" {
+		return nil, http.StatusBadRequest, errors.New("album needs a name")
+	}
+	if edit.CoverPhotoID != nil {
+		ok, err := s.ps.HasAlbumPhoto(album.ID, *edit.CoverPhotoID)
+		if err != nil {
+			log.Println("could not check album photo. ID: "+album.ID, err)
+			return nil, http.StatusInternalServerError, errors.New("could not update album")
+		}
+		if !ok {
+			return nil, http.StatusBadRequest, errors.New("the cover photo must be in the album")
+		}
+	}
+
+	album.Name = edit.Name
+	album.Description = edit.Description
+	album.CoverPhotoID = edit.CoverPhotoID
+	album.ModifiedAt = time.Now()
+	err = s.ps.UpdateAlbum(album)
+	if err != nil {
+		log.Println("could not update album. ID: "+album.ID, err)
+		return nil, http.StatusInternalServerError, errors.New("could not update album")
+	}
+	log.Println("edited album. ID: " + album.ID)
+	return s.GetAlbumById(album.ID)
+}
+
+// DeleteAlbum Delete an album, leaving the photos that were in it alone
+func (s *service) DeleteAlbum(id string) (int, error) {
+	_, status, err := s.GetAlbumById(id)
+	if err != nil {
+		return status, err
+	}
+	err = s.ps.DeleteAlbum(id)
+	if err != nil {
+		log.Println("could not delete album. ID: "+id, err)
+		return http.StatusInternalServerError, errors.New("could not delete album")
+	}
+	log.Println("deleted album. ID: " + id)
+	return http.StatusNoContent, nil
+}
+
+// ReorderAlbums Put the albums in the given order, every album has to be listed exactly once
+func (s *service) ReorderAlbums(ids []string) ([]*Album, int, error) {
+	albums, status, err := s.GetAlbums()
+	if err != nil {
+		return nil, status, err
+	}
+	current := make([]string, 0, len(albums))
+	for _, album := range albums {
+		current = append(current, album.ID)
+	}
+	if !sameIDs(current, ids) {
+		return nil, http.StatusBadRequest, errors.New("ids must list every album exactly once")
+	}
+	err = s.ps.ReorderAlbums(ids)
+	if err != nil {
+		log.Println("could not reorder albums", err)
+		return nil, http.StatusInternalServerError, errors.New("could not reorder albums")
+	}
+	return s.GetAlbums()
+}
+
+// GetAlbumPhotos Get the photos in an album, in order
+func (s *service) GetAlbumPhotos(id string) ([]*Photo, int, error) {
+	_, status, err := s.GetAlbumById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	photos, err := s.ps.GetAlbumPhotos(id)
+	if err != nil {
+		log.Println("could not get album photos. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get album photos")
+	}
+	return photos, http.StatusOK, nil
+}
+
+// AddAlbumPhotos Add photos to the end of an album, in the order they're given.
+// Photos that are already in the album keep their place.
+func (s *service) AddAlbumPhotos(id string, photoIDs []string) ([]*Photo, int, error) {
+	if len(photoIDs) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no photo ids given")
+	}
+	_, status, err := s.GetAlbumById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	added, err := s.ps.AddAlbumPhotos(id, photoIDs)
+	if err != nil {
+		log.Println("could not add album photos. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not add photos to album")
+	}
+	log.Println("added", added, "photos to album. ID: "+id)
+	return s.GetAlbumPhotos(id)
+}
+
+// RemoveAlbumPhoto Take a photo out of an album, the photo itself is kept
+func (s *service) RemoveAlbumPhoto(id string, photoID string) (int, error) {
+	removed, err := s.ps.RemoveAlbumPhoto(id, photoID)
+	if err != nil {
+		log.Println("could not remove album photo. ID: "+id+" Photo: "+photoID, err)
+		return http.StatusInternalServerError, errors.New("could not remove photo from album")
+	}
+	if removed == 0 {
+		return http.StatusNotFound, errors.New("photo is not in the album")
+	}
+	log.Println("removed photo from album. ID: " + id + " Photo: " + photoID)
+	return http.StatusNoContent, nil
+}
+
+// ReorderAlbumPhotos Put the photos in an album in the given order, every photo has to be listed exactly once
+func (s *service) ReorderAlbumPhotos(id string, photoIDs []string) ([]*Photo, int, error) {
+	photos, status, err := s.GetAlbumPhotos(id)
+	if err != nil {
+		return nil, status, err
+	}
+	current := make([]string, 0, len(photos))
+	for _, photo := range photos {
+		current = append(current, photo.ID)
+	}
+	if !sameIDs(current, photoIDs) {
+		return nil, http.StatusBadRequest, errors.New("ids must list every photo in the album exactly once")
+	}
+	err = s.ps.ReorderAlbumPhotos(id, photoIDs)
+	if err != nil {
+		log.Println("could not reorder album photos. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not reorder album photos")
+	}
+	return s.GetAlbumPhotos(id)
+}
+
+// ------------------- Functions -------------------
+
+// sameIDs Whether two lists hold the same IDs, ignoring order. Neither list may repeat an ID.
+func sameIDs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b) && len(slices.Compact(a)) == len(b)
+}
+
+// decodeIDList Decode a list of IDs from the request body
+func decodeIDList(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	list := IDList{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		log.Println("Could not decode ids", err)
+		responses.BadRequest(w, r, "Could not decode ids")
+		return nil, false
+	}
+	return list.IDs, true
+}
+
+// ------------------- Handlers -------------------
+
+// GetAlbums Get every album
+func GetAlbums(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, status, err := s.GetAlbums()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, albums)
+	}
+}
+
+// CreateAlbum Create an album from its name and description
+func CreateAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album := Album{}
+		err := json.NewDecoder(r.Body).Decode(&album)
+		if err != nil {
+			log.Println("Could not decode album", err)
+			responses.BadRequest(w, r, "Could not decode album")
+			return
+		}
+		status, err := s.CreateAlbum(&album)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructCreated(w, r, album)
+	}
+}
+
+// GetAlbum Get an album by the ID in the path
+func GetAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, status, err := s.GetAlbumById(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, album)
+	}
+}
+
+// UpdateAlbum Rename an album, or change its description or cover photo
+func UpdateAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		edit := Album{}
+		err := json.NewDecoder(r.Body).Decode(&edit)
+		if err != nil {
+			log.Println("Could not decode album", err)
+			responses.BadRequest(w, r, "Could not decode album")
+			return
+		}
+		edit.ID = r.PathValue("id")
+		album, status, err := s.EditAlbum(&edit)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, album)
+	}
+}
+
+// DeleteAlbum Delete an album, without deleting its photos
+func DeleteAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := s.DeleteAlbum(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.NoContent(w)
+	}
+}
+
+// ReorderAlbums Put the albums in the order of {"ids": [...]}
+func ReorderAlbums(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, ok := decodeIDList(w, r)
+		if !ok {
+			return
+		}
+		albums, status, err := s.ReorderAlbums(ids)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, albums)
+	}
+}
+
+// GetAlbumPhotos Get the photos in an album, in order
+func GetAlbumPhotos(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		photos, status, err := s.GetAlbumPhotos(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		sendPhotos(w, r, photos)
+	}
+}
+
+// AddAlbumPhotos Add the photos in {"ids": [...]} to the end of an album
+func AddAlbumPhotos(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, ok := decodeIDList(w, r)
+		if !ok {
+			return
+		}
+		photos, status, err := s.AddAlbumPhotos(r.PathValue("id"), ids)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, photos)
+	}
+}
+
+// RemoveAlbumPhoto Take a photo out of an album
+func RemoveAlbumPhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := s.RemoveAlbumPhoto(r.PathValue("id"), r.PathValue("photo_id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.NoContent(w)
+	}
+}
+
+// ReorderAlbumPhotos Put the photos in an album in the order of {"ids": [...]}
+func ReorderAlbumPhotos(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, ok := decodeIDList(w, r)
+		if !ok {
+			return
+		}
+		photos, status, err := s.ReorderAlbumPhotos(r.PathValue("id"), ids)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, photos)
+	}
+}
+
+// getAlbumView Get an album and its photos, sending an error response if that fails
+func getAlbumView(s PhotoService, w http.ResponseWriter, r *http.Request, id string) (*AlbumView, error) {
+	album, status, err := s.GetAlbumById(id)
+	if err != nil {
+		responses.SwitchCase(w, r, status, err.Error())
+		return nil, err
+	}
+	photos, status, err := s.GetAlbumPhotos(id)
+	if err != nil {
+		responses.SwitchCase(w, r, status, err.Error())
+		return nil, err
+	}
+	return &AlbumView{Album: album, Photos: photos}, nil
+}
+
+// GetAlbumsHTML Render the list of albums, opening the album in the path if there is one
+func GetAlbumsHTML(s PhotoService, cw web.FuncWrapper[*AlbumsPage]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, status, err := s.GetAlbums()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		page := &AlbumsPage{Albums: albums}
+		if id := r.PathValue("id"); id != "" {
+			page.Open, err = getAlbumView(s, w, r, id)
+			if err != nil {
+				return
+			}
+		}
+		responses.SendComponent(w, r, cw(page))
+	}
+}
+
+// GetAlbumHTML Render a single album, for swapping into the album list
+func GetAlbumHTML(s PhotoService, cw web.FuncWrapper[*AlbumView]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view, err := getAlbumView(s, w, r, r.PathValue("id"))
+		if err != nil {
+			return
+		}
+		responses.SendComponent(w, r, cw(view))
+	}
+}
@@ -0,0 +1,115 @@
+package photodump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"home_api/src/database"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/minio/minio-go/v7"
+	"github.com/nfnt/resize"
+)
+
+// ------------------- Types -------------------
+
+// Derivative A resized WebP copy of a photo, stored alongside the original
+type Derivative struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	File   string `json:"file"`
+}
+
+// DerivativeWidths The widths that derivatives are generated at
+var DerivativeWidths = []int{256, 768, 1600}
+
+// DerivativeQuality The WebP quality used when encoding derivatives
+const DerivativeQuality = 80
+
+// Thumbnail The smallest version of the photo, falling back to the full size one
+func (p *Photo) Thumbnail() string {
+	if len(p.Derivatives) == 0 {
+		return p.Display()
+	}
+	return p.Derivatives[0].File
+}
+
+// SrcSet The derivatives and full size photo as an HTML srcset attribute
+func (p *Photo) SrcSet() string {
+	var srcset []string
+	for _, d := range p.Derivatives {
+		srcset = append(srcset, d.File+" "+strconv.Itoa(d.Width)+"w")
+	}
+	w, _, ok := strings.Cut(p.Resolution, "x")
+	if ok {
+		srcset = append(srcset, p.Display()+" "+w+"w")
+	}
+	return strings.Join(srcset, ", ")
+}
+
+// ------------------- Store -------------------
+
+// derivativeObject The S3 object name of a derivative
+func derivativeObject(photo *Photo, width int) string {
+	return photo.ID + "_" + strconv.Itoa(width) + ".webp"
+}
+
+// UploadDerivativeToS3 Upload a derivative of a photo to S3
+func (s *store) UploadDerivativeToS3(photo *Photo, d *Derivative, bs []byte) error {
+	object := derivativeObject(photo, d.Width)
+	_, err := s.s3.PutObject(
+		context.Background(), "photos", object, bytes.NewReader(bs), int64(len(bs)),
+		minio.PutObjectOptions{ContentType: "image/webp"})
+	if err != nil {
+		return err
+	}
+	d.File = database.S3_FILE_URI + "/photos/" + object
+	return nil
+}
+
+// DeleteDerivativesFromS3 Delete all the derivatives of a photo from S3
+func (s *store) DeleteDerivativesFromS3(photo *Photo) error {
+	var errs []error
+	for _, d := range photo.Derivatives {
+		err := s.s3.RemoveObject(
+			context.Background(), "photos", derivativeObject(photo, d.Width),
+			minio.RemoveObjectOptions{})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ------------------- Service -------------------
+
+// GenerateDerivatives Resize the photo to each of the derivative widths, and upload them to S3.
+// Widths that are at least as wide as the original are skipped.
+func (s *service) GenerateDerivatives(photo *Photo, img image.Image) error {
+	photo.Derivatives = make([]Derivative, 0, len(DerivativeWidths))
+	for _, width := range DerivativeWidths {
+		if width >= img.Bounds().Dx() {
+			break
+		}
+		resized := resize.Resize(uint(width), 0, img, resize.Lanczos3)
+		var buf bytes.Buffer
+		err := webp.Encode(&buf, resized, &webp.Options{Quality: DerivativeQuality})
+		if err != nil {
+			log.Println("could not encode derivative. ID: "+photo.ID+" Width: "+strconv.Itoa(width), err)
+			return errors.New("could not encode derivative")
+		}
+		d := Derivative{Width: width, Height: resized.Bounds().Dy()}
+		err = s.ps.UploadDerivativeToS3(photo, &d, buf.Bytes())
+		if err != nil {
+			log.Println("could not upload derivative to S3. ID: "+photo.ID+" Width: "+strconv.Itoa(width), err)
+			return errors.New("could not upload derivative to S3")
+		}
+		photo.Derivatives = append(photo.Derivatives, d)
+	}
+	log.Println("generated derivatives. ID: " + photo.ID)
+	return nil
+}
@@ -0,0 +1,173 @@
+package photodump
+
+import (
+	"errors"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kolesa-team/goexiv"
+)
+
+// -------------- Globals --------------
+
+// iptcUTF8 The IPTC coded character set escape sequence for UTF-8
+const iptcUTF8 = "\x1b%G"
+
+// metadataFormats The formats Exiv2 can write metadata to, the rest are downloaded as they were uploaded
+var metadataFormats = []string{"image/jpeg", "image/png", "image/webp"}
+
+// errMetadataUnsupported Metadata can't be written to the format of the file
+var errMetadataUnsupported = errors.New("metadata can't be written to this format")
+
+// staleXmpKeys The XMP keys holding the fields that are written on download.
+// Apps prefer XMP over the rest, so they're removed from the file, then written again for JPEGs.
+var staleXmpKeys = []string{
+	"Xmp.dc.description",
+	"Xmp.dc.subject",
+	"Xmp.lr.hierarchicalSubject",
+	"Xmp.photoshop.DateCreated",
+	"Xmp.exif.DateTimeOriginal",
+	"Xmp.photoshop.Source",
+}
+
+// ------------------- Service -------------------
+
+// DownloadPhoto Get the original of a photo with its description, tags, subjects and time taken embedded,
+// falling back to the file as it was uploaded when its format can't be written
+func (s *service) DownloadPhoto(id string) (*Photo, []byte, int, error) {
+	photo, status, err := s.GetPhotoById(id)
+	if err != nil {
+		return nil, nil, status, err
+	}
+	original, err := s.ps.GetPhotoFromS3(photo)
+	if err != nil {
+		log.Println("could not get photo from S3. ID: "+id, err)
+		return nil, nil, http.StatusInternalServerError, errors.New("could not get photo")
+	}
+
+	keywords := slices.Clone(photo.Tags)
+	keywords = append(keywords, photo.Subjects...)
+	// People named only by a region aren't in the subjects
+	if len(photo.People) > 0 {
+		for _, person := range s.GetPeople() {
+			if slices.Contains(photo.People, person.ID) && !slices.Contains(keywords, person.FullName()) {
+				keywords = append(keywords, person.FullName())
+			}
+		}
+	}
+
+	bs, err := photo.EmbedMetadata(original, keywords)
+	if errors.Is(err, errMetadataUnsupported) {
+		return photo, original, http.StatusOK, nil
+	}
+	if err != nil {
+		log.Println("could not embed photo metadata. ID: "+id, err)
+		return nil, nil, http.StatusInternalServerError, errors.New("could not embed photo metadata")
+	}
+	return photo, bs, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// EmbedMetadata Write the description, source, keywords and time taken of the photo into a copy of its file.
+// goexiv writes the EXIF and IPTC, but can only set one value per IPTC tag and can't write XMP,
+// so for JPEGs the keywords and XMP are written by embedJPEGMetadata afterwards.
+// Other formats get the keywords in a single comma separated Keywords tag, and no XMP.
+func (p *Photo) EmbedMetadata(bs []byte, keywords []string) ([]byte, error) {
+	contentType := DetectImageType(bs)
+	if !slices.Contains(metadataFormats, contentType) {
+		return nil, errMetadataUnsupported
+	}
+	isJPEG := contentType == "image/jpeg"
+	img, err := goexiv.OpenBytes(bs)
+	if err != nil {
+		return nil, err
+	}
+	err = img.ReadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	exif := img.GetExifData().AllTags()
+	iptc := iptcTags(img.GetIptcData())
+
+	// Every goexiv set and strip writes the whole file again, so tags that are already right are left alone.
+	// Stripping a key the file doesn't have doesn't write anything.
+	setOrStrip := func(tags map[string]string, set func(string, string) error, strip func(string) error, key string, value string) {
+		current, ok := tags[key]
+		if err != nil || current == value && (ok || value == "") {
+			return
+		}
+		if value == "" {
+			err = strip(key)
+			return
+		}
+		err = set(key, value)
+	}
+	setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Envelope.CharacterSet", iptcUTF8)
+	for _, key := range staleXmpKeys {
+		if err == nil {
+			err = img.XmpStripKey(key)
+		}
+	}
+	if !isJPEG {
+		// Repeated tags are stripped one at a time
+		joined := strings.Join(keywords, ", ")
+		if iptc["Iptc.Application2.Keywords"] != joined {
+			for range strings.Count(iptc["Iptc.Application2.Keywords"], "\n") + 1 {
+				if err == nil {
+					err = img.IptcStripKey("Iptc.Application2.Keywords")
+				}
+			}
+			delete(iptc, "Iptc.Application2.Keywords")
+		}
+		setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Application2.Keywords", joined)
+	}
+	setOrStrip(exif, img.SetExifString, img.ExifStripKey, "Exif.Image.ImageDescription", p.Description)
+	setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Application2.Caption", p.Description)
+	setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Application2.Source", p.Source)
+	if !p.TakenAt.IsZero() {
+		taken := p.LocalTakenAt()
+		offset := ""
+		if p.TakenAtOffset != nil {
+			offset = taken.Format("-07:00")
+		}
+		// DateTimeOriginal is read from the main IFD first, so an old one there would win
+		setOrStrip(exif, img.SetExifString, img.ExifStripKey, "Exif.Image.DateTimeOriginal", "")
+		setOrStrip(exif, img.SetExifString, img.ExifStripKey, "Exif.Photo.DateTimeOriginal", taken.Format("2006:01:02 15:04:05"))
+		setOrStrip(exif, img.SetExifString, img.ExifStripKey, "Exif.Photo.OffsetTimeOriginal", offset)
+		setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Application2.DateCreated", taken.Format("20060102"))
+		setOrStrip(iptc, img.SetIptcString, img.IptcStripKey, "Iptc.Application2.TimeCreated", taken.Format("150405-0700"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isJPEG {
+		return img.GetBytes(), nil
+	}
+	return embedJPEGMetadata(img.GetBytes(), keywords, p.xmpDescription(keywords))
+}
+
+// ------------------- Handlers -------------------
+
+// DownloadPhoto Send the original of the photo in the path as an attachment, with its metadata embedded
+func DownloadPhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		photo, bs, status, err := s.DownloadPhoto(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", DetectImageType(bs))
+		w.Header().Set("Content-Length", strconv.Itoa(len(bs)))
+		w.Header().Set("Content-Disposition", `attachment; filename="`+photoObject(photo)+`"`)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(bs)
+		if err != nil {
+			log.Println("could not send photo. ID: "+photo.ID, err)
+		}
+	}
+}
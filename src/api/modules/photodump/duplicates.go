@@ -0,0 +1,238 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/api/modules/familytree"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ------------------- Types -------------------
+
+// DuplicatePolicy What to do when an upload looks like a photo that's already stored
+type DuplicatePolicy string
+
+const (
+	// RejectDuplicates Refuse the upload with a 409 Conflict
+	RejectDuplicates DuplicatePolicy = "reject"
+	// AllowDuplicates Store the upload as a new, unrelated photo
+	AllowDuplicates DuplicatePolicy = "allow"
+	// ReplaceDuplicates Keep whichever copy has the highest resolution
+	ReplaceDuplicates DuplicatePolicy = "replace"
+	// LinkDuplicates Store the upload as a variant of the closest match
+	LinkDuplicates DuplicatePolicy = "link-as-variant"
+)
+
+// Valid Whether the policy is one of the known policies
+func (p DuplicatePolicy) Valid() bool {
+	switch p {
+	case RejectDuplicates, AllowDuplicates, ReplaceDuplicates, LinkDuplicates:
+		return true
+	}
+	return false
+}
+
+// UploadOptions Options that control how an upload is handled
+type UploadOptions struct {
+	Policy   DuplicatePolicy
+	Distance int
+	// People The family tree to link uploads to, read once for a whole request rather than for every file.
+	// It's nil if it couldn't be read, uploads aren't linked to anyone then.
+	People []*familytree.Person
+	// Actor Who made the upload, recorded in the history of the photos it replaces
+	Actor string
+}
+
+// DuplicateError Returned when an upload conflicts with photos that are already stored
+type DuplicateError struct {
+	Message string
+	IDs     []string
+}
+
+func (e *DuplicateError) Error() string {
+	return e.Message
+}
+
+// -------------- Globals --------------
+
+var defaultDuplicatePolicy = func() DuplicatePolicy {
+	policy := DuplicatePolicy(os.Getenv("PHOTO_DUPLICATE_POLICY"))
+	if policy == "" {
+		return RejectDuplicates
+	}
+	if !policy.Valid() {
+		log.Println("Invalid PHOTO_DUPLICATE_POLICY, defaulting to " + RejectDuplicates)
+		return RejectDuplicates
+	}
+	return policy
+}()
+
+var defaultDuplicateDistance = func() int {
+	str := os.Getenv("PHOTO_DUPLICATE_DISTANCE")
+	if str == "" {
+		return 0
+	}
+	hd, err := strconv.Atoi(str)
+	if err != nil || hd < 0 || hd > MaxLikeDistance {
+		log.Println("Invalid PHOTO_DUPLICATE_DISTANCE, defaulting to 0")
+		return 0
+	}
+	return hd
+}()
+
+// DefaultUploadOptions The upload options used when a request doesn't specify any
+func DefaultUploadOptions() UploadOptions {
+	return UploadOptions{
+		Policy:   defaultDuplicatePolicy,
+		Distance: defaultDuplicateDistance,
+	}
+}
+
+// ------------------- Store -------------------
+
+// RelinkVariants Point the variants of the given photos at a different photo
+func (s *store) RelinkVariants(from []string, to string) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE photos SET variant_of = $2 WHERE variant_of = ANY($1) AND id <> $2", from, to)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ------------------- Service -------------------
+
+// applyDuplicatePolicy Decide what to do with a photo that looks like the given photos.
+// Returns the photos that should be removed once the upload has been stored.
+func (s *service) applyDuplicatePolicy(photo *Photo, likePhotos []*LikePhoto, opts UploadOptions) ([]*LikePhoto, int, error) {
+	if len(likePhotos) == 0 {
+		return nil, http.StatusCreated, nil
+	}
+	ids := make([]string, 0, len(likePhotos))
+	for _, likePhoto := range likePhotos {
+		ids = append(ids, likePhoto.ID)
+	}
+
+	switch opts.Policy {
+	case AllowDuplicates:
+		return nil, http.StatusCreated, nil
+	case LinkDuplicates:
+		// Results are sorted by distance, so the first one is the closest match
+		original := likePhotos[0].ID
+		if likePhotos[0].VariantOf != nil {
+			original = *likePhotos[0].VariantOf
+		}
+		photo.VariantOf = &original
+		log.Println("linking photo as a variant. ID: " + photo.ID + " Original: " + original)
+		return nil, http.StatusCreated, nil
+	case ReplaceDuplicates:
+		for _, likePhoto := range likePhotos {
+			if likePhoto.Pixels() >= photo.Pixels() {
+				log.Println("higher resolution duplicate exists. ID: " + photo.ID)
+				return nil, http.StatusConflict, &DuplicateError{
+					Message: "a higher resolution copy of this image already exists", IDs: ids}
+			}
+		}
+		for _, likePhoto := range likePhotos {
+			photo.Inherit(&likePhoto.Photo)
+		}
+		return likePhotos, http.StatusCreated, nil
+	default:
+		log.Println("duplicate image. ID: " + photo.ID)
+		return nil, http.StatusConflict, &DuplicateError{Message: "duplicate image", IDs: ids}
+	}
+}
+
+// removeReplacedPhotos Move the photos that an upload replaced to the trash, so a bad match can be restored
+func (s *service) removeReplacedPhotos(photo *Photo, replaced []*LikePhoto, actor string) {
+	ids := make([]string, 0, len(replaced))
+	for _, likePhoto := range replaced {
+		ids = append(ids, likePhoto.ID)
+	}
+	err := s.ps.RelinkVariants(ids, photo.ID)
+	if err != nil {
+		log.Println("could not relink variants of replaced photos. ID: "+photo.ID, err)
+	}
+	for _, likePhoto := range replaced {
+		_, err = s.trashPhoto(&likePhoto.Photo)
+		if err != nil {
+			continue
+		}
+		s.recordHistory(likePhoto.ID, HistoryDelete, actor, nil)
+		log.Println("replaced photo. ID: " + likePhoto.ID + " Replacement: " + photo.ID)
+	}
+}
+
+// ------------------- Functions -------------------
+
+// UploadOptionsFromValues Read the duplicate policy and distance from form values
+func UploadOptionsFromValues(values url.Values) (UploadOptions, error) {
+	opts := DefaultUploadOptions()
+	if policy := values.Get("duplicate_policy"); policy != "" {
+		opts.Policy = DuplicatePolicy(policy)
+		if !opts.Policy.Valid() {
+			return opts, errors.New("invalid duplicate policy: " + policy)
+		}
+	}
+	if distance := values.Get("duplicate_distance"); distance != "" {
+		hd, err := strconv.Atoi(distance)
+		if err != nil || hd < 0 || hd > MaxLikeDistance {
+			return opts, errors.New("duplicate distance must be between 0 and " + strconv.Itoa(MaxLikeDistance))
+		}
+		opts.Distance = hd
+	}
+	return opts, nil
+}
+
+// Pixels The number of pixels in the photo, according to its resolution
+func (p *Photo) Pixels() int {
+	w, h, ok := strings.Cut(strings.TrimSuffix(p.Resolution, "p"), "x")
+	if !ok {
+		return 0
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return 0
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0
+	}
+	return width * height
+}
+
+// Inherit Fill in the user provided metadata that's missing from the photo using another photo
+func (p *Photo) Inherit(other *Photo) {
+	if p.Description == "" {
+		p.Description = other.Description
+	}
+	if p.Source == "" {
+		p.Source = other.Source
+	}
+	for _, subject := range other.Subjects {
+		if !slices.Contains(p.Subjects, subject) {
+			p.Subjects = append(p.Subjects, subject)
+		}
+	}
+	for _, tag := range other.Tags {
+		if !slices.Contains(p.Tags, tag) {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	for _, person := range other.People {
+		if !slices.Contains(p.People, person) {
+			p.People = append(p.People, person)
+		}
+	}
+	if other.TakenAtSource == ManualTime || (!other.TakenAt.IsZero() && other.TakenAt.Before(p.TakenAt)) {
+		p.TakenAt = other.TakenAt
+		p.TakenAtSource = other.TakenAtSource
+		p.TakenAtOffset = other.TakenAtOffset
+	}
+}
@@ -0,0 +1,180 @@
+package photodump
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"home_api/src/database"
+	"image"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/chai2010/webp"
+	"github.com/minio/minio-go/v7"
+)
+
+// -------------- Globals --------------
+
+// RenditionQuality The quality used when encoding full size renditions
+const RenditionQuality = 90
+
+// heicBrands ISO-BMFF brands used by HEIC files, see https://nokiatech.github.io/heif/technical.html
+var heicBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "hevm", "hevs"}
+
+// heifBrands Generic HEIF brands that don't say which codec is used
+var heifBrands = []string{"mif1", "msf1"}
+
+// avifBrands ISO-BMFF brands used by AVIF files
+var avifBrands = []string{"avif", "avis"}
+
+// renditionFormat The format of the renditions stored next to originals that browsers can't display,
+// one of "webp", "jpeg" or "none"
+var renditionFormat = func() string {
+	format := os.Getenv("PHOTO_RENDITION_FORMAT")
+	switch format {
+	case "":
+		return "webp"
+	case "webp", "jpeg", "none":
+		return format
+	}
+	log.Println("Invalid PHOTO_RENDITION_FORMAT, defaulting to webp")
+	return "webp"
+}()
+
+// ------------------- Functions -------------------
+
+// DetectImageType Detect the content type of a file, including the ISO-BMFF based image formats
+// that http.DetectContentType doesn't know about
+func DetectImageType(head []byte) string {
+	// The file starts with an ftyp box: size, "ftyp", major brand, minor version, compatible brands
+	if len(head) >= 16 && string(head[4:8]) == "ftyp" {
+		size := int(binary.BigEndian.Uint32(head[:4]))
+		if size < 16 || size > len(head) {
+			size = len(head)
+		}
+		brands := []string{string(head[8:12])}
+		for i := 16; i+4 <= size; i += 4 {
+			brands = append(brands, string(head[i:i+4]))
+		}
+		for _, brand := range brands {
+			if slices.Contains(avifBrands, brand) {
+				return "image/avif"
+			}
+		}
+		for _, brand := range brands {
+			if slices.Contains(heicBrands, brand) {
+				return "image/heic"
+			}
+		}
+		for _, brand := range brands {
+			if slices.Contains(heifBrands, brand) {
+				return "image/heif"
+			}
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+// NeedsRendition Whether browsers need a different format to display images of this type
+func NeedsRendition(ext string) bool {
+	switch ext {
+	case "heic", "heif", "avif":
+		return true
+	}
+	return false
+}
+
+// ImageOrientation The orientation needed to display an image upright.
+// HEIF based formats store their rotation in the container, which the decoder already applies,
+// so their EXIF orientation is only informational.
+func ImageOrientation(ext string, bs []byte) Orientation {
+	switch ext {
+	case "heic", "heif", "avif":
+		return Normal
+	}
+	return ExifOrientation(bs)
+}
+
+// Display The version of the photo that browsers can display
+func (p *Photo) Display() string {
+	if p.Rendition != "" {
+		return p.Rendition
+	}
+	return p.File
+}
+
+// ------------------- Store -------------------
+
+// UploadRenditionToS3 Upload the full size rendition of a photo to S3
+func (s *store) UploadRenditionToS3(photo *Photo, ext string, contentType string, bs []byte) error {
+	object := photo.ID + "_full." + ext
+	_, err := s.s3.PutObject(
+		context.Background(), "photos", object, bytes.NewReader(bs), int64(len(bs)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	photo.Rendition = database.S3_FILE_URI + "/photos/" + object
+	return nil
+}
+
+// DeleteRenditionFromS3 Delete the full size rendition of a photo from S3, if it has one
+func (s *store) DeleteRenditionFromS3(photo *Photo) error {
+	if photo.Rendition == "" {
+		return nil
+	}
+	err := s.s3.RemoveObject(
+		context.Background(), "photos", path.Base(photo.Rendition),
+		minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdatePhotoRendition Update only the rendition of a Photo in the database,
+// as long as its original hasn't moved since it was generated. Returns whether it was updated.
+func (s *store) UpdatePhotoRendition(p *Photo) (bool, error) {
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE photos SET rendition = $2 WHERE id = $1 AND file = $3 AND deleted_at IS NULL",
+		p.ID, p.Rendition, p.File)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ------------------- Service -------------------
+
+// GenerateRendition Encode a full size copy of the photo in a format browsers can display, and upload it to S3
+func (s *service) GenerateRendition(photo *Photo, img image.Image) error {
+	var buf bytes.Buffer
+	var err error
+	var ext, contentType string
+	switch renditionFormat {
+	case "jpeg":
+		ext, contentType = "jpg", "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: RenditionQuality})
+	case "webp":
+		ext, contentType = "webp", "image/webp"
+		err = webp.Encode(&buf, img, &webp.Options{Quality: RenditionQuality})
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Println("could not encode rendition. ID: "+photo.ID, err)
+		return errors.New("could not encode rendition")
+	}
+	err = s.ps.UploadRenditionToS3(photo, ext, contentType, buf.Bytes())
+	if err != nil {
+		log.Println("could not upload rendition to S3. ID: "+photo.ID, err)
+		return errors.New("could not upload rendition to S3")
+	}
+	log.Println("generated rendition. ID: " + photo.ID)
+	return nil
+}
@@ -0,0 +1,345 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// NearPhoto A Photo along with its distance in kilometres from a reference point
+type NearPhoto struct {
+	Photo
+	DistanceKm float64 `json:"distance_km" db:"distance_km"`
+}
+
+// BoundingBox An area on the map, longitudes wrap around the antimeridian when West is greater than East
+type BoundingBox struct {
+	West  float64 `json:"west"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	North float64 `json:"north"`
+}
+
+// Circle An area on the map within a radius of a point
+type Circle struct {
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	RadiusKm float64 `json:"radius_km"`
+}
+
+// FeatureCollection A GeoJSON FeatureCollection, see https://datatracker.ietf.org/doc/html/rfc7946
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+// Feature A GeoJSON Feature for a photo
+type Feature struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Geometry   *Point            `json:"geometry"`
+	Properties FeatureProperties `json:"properties"`
+}
+
+// Point A GeoJSON Point, with the coordinates in longitude, latitude order
+type Point struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// FeatureProperties The details of a photo that are shown on a map
+type FeatureProperties struct {
+	File        string    `json:"file"`
+	Thumbnail   string    `json:"thumbnail"`
+	Description string    `json:"description"`
+	TakenAt     time.Time `json:"taken_at"`
+	DistanceKm  *float64  `json:"distance_km,omitempty"`
+}
+
+// -------------- Globals --------------
+
+// KmPerDegree The length of a degree of latitude
+const KmPerDegree = 111.2
+
+// MaxRadiusKm The largest radius that can be searched, half way around the world
+const MaxRadiusKm = 20016.0
+
+// DefaultGeoAmount How many photos are returned from a map query by default
+const DefaultGeoAmount = 500
+
+// ------------------- Store -------------------
+
+// distanceKmSQL The distance in kilometres between a photo and a point,
+// using the haversine formula with the Earth's mean radius
+func distanceKmSQL(lat string, lon string) string {
+	return `6371 * 2 * ASIN(LEAST(1, SQRT(
+		POWER(SIN(RADIANS(latitude - ` + lat + `) / 2), 2) +
+		COS(RADIANS(` + lat + `)) * COS(RADIANS(latitude)) * POWER(SIN(RADIANS(longitude - ` + lon + `) / 2), 2)
+	)))`
+}
+
+// inBoxSQL Whether a photo is inside a bounding box, wrapping around the antimeridian when west is greater than east
+func inBoxSQL(west string, south string, east string, north string) string {
+	return `latitude BETWEEN ` + south + `::DOUBLE PRECISION AND ` + north + `::DOUBLE PRECISION
+AND CASE WHEN ` + west + `::DOUBLE PRECISION <= ` + east + `::DOUBLE PRECISION
+	THEN longitude BETWEEN ` + west + ` AND ` + east + `
+	ELSE longitude >= ` + west + ` OR longitude <= ` + east + `
+END`
+}
+
+// getPhotosNearQuery Only looks at photos in the band of latitudes the radius covers so the latitude index can be used
+var getPhotosNearQuery = `
+SELECT * FROM (
+	SELECT ` + photoColumns + `, ` + distanceKmSQL("$1", "$2") + ` AS distance_km
+	FROM photos
+	WHERE deleted_at IS NULL AND latitude BETWEEN $1 - $4 AND $1 + $4 AND longitude IS NOT NULL
+) AS near
+WHERE distance_km <= $3
+ORDER BY distance_km ASC, taken_at DESC
+LIMIT NULLIF($5, 0)`
+
+// GetPhotosNear Get the photos taken within a radius of a point, closest first
+func (s *store) GetPhotosNear(lat float64, lon float64, radiusKm float64, limit int) ([]*NearPhoto, error) {
+	rows, err := s.db.Query(context.Background(), getPhotosNearQuery,
+		lat, lon, radiusKm, radiusKm/KmPerDegree, limit)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[NearPhoto])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+var getPhotosInBoxQuery = `
+SELECT ` + photoColumns + ` FROM photos
+WHERE deleted_at IS NULL AND ` + inBoxSQL("$1", "$2", "$3", "$4") + `
+ORDER BY taken_at DESC
+LIMIT NULLIF($5, 0)`
+
+// GetPhotosInBox Get the photos taken inside a bounding box, newest first
+func (s *store) GetPhotosInBox(box BoundingBox, limit int) ([]*Photo, error) {
+	rows, err := s.db.Query(context.Background(), getPhotosInBoxQuery,
+		box.West, box.South, box.East, box.North, limit)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+// ------------------- Service -------------------
+
+// GetPhotosNear Get the photos taken within a radius of a point, closest first
+func (s *service) GetPhotosNear(lat float64, lon float64, radiusKm float64, limit int) ([]*NearPhoto, int, error) {
+	err := Circle{Lat: lat, Lon: lon, RadiusKm: radiusKm}.Validate()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	photos, err := s.ps.GetPhotosNear(lat, lon, radiusKm, limit)
+	if err != nil {
+		log.Println("could not get photos near point", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photos near point")
+	}
+	return photos, http.StatusOK, nil
+}
+
+// GetPhotosInBox Get the photos taken inside a bounding box, newest first
+func (s *service) GetPhotosInBox(box BoundingBox, limit int) ([]*Photo, int, error) {
+	err := box.Validate()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	photos, err := s.ps.GetPhotosInBox(box, limit)
+	if err != nil {
+		log.Println("could not get photos in bounding box", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photos in bounding box")
+	}
+	return photos, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// Validate Check the circle is on the map and its radius is in range
+func (c Circle) Validate() error {
+	if c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180 {
+		return errors.New("lat must be between -90 and 90, and lon between -180 and 180")
+	}
+	if c.RadiusKm <= 0 || c.RadiusKm > MaxRadiusKm {
+		return errors.New("radius_km must be greater than 0 and at most " +
+			strconv.FormatFloat(MaxRadiusKm, 'f', -1, 64))
+	}
+	return nil
+}
+
+// Validate Check the bounding box is on the map
+func (b BoundingBox) Validate() error {
+	if b.South < -90 || b.North > 90 || b.South > b.North {
+		return errors.New("latitudes must be between -90 and 90, with south below north")
+	}
+	if b.West < -180 || b.West > 180 || b.East < -180 || b.East > 180 {
+		return errors.New("longitudes must be between -180 and 180")
+	}
+	return nil
+}
+
+// QueryFloat Read a required float from the query string
+func QueryFloat(r *http.Request, key string) (float64, error) {
+	str := r.URL.Query().Get(key)
+	if str == "" {
+		return 0, errors.New("no " + key + " in the query")
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, errors.New("invalid " + key)
+	}
+	return f, nil
+}
+
+// ParseBoundingBox Parse a bounding box in the GeoJSON order of "west,south,east,north"
+func ParseBoundingBox(str string) (BoundingBox, error) {
+	parts := strings.Split(str, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, errors.New("bbox must be west,south,east,north")
+	}
+	var coords [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BoundingBox{}, errors.New("bbox must be west,south,east,north")
+		}
+		coords[i] = f
+	}
+	return BoundingBox{West: coords[0], South: coords[1], East: coords[2], North: coords[3]}, nil
+}
+
+// WantsGeoJSON Whether the request asked for GeoJSON, either with the Accept header or ?format=geojson
+func WantsGeoJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "geojson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/geo+json")
+}
+
+// Feature The photo as a GeoJSON Feature, with a null geometry if it has no location
+func (p *Photo) Feature() *Feature {
+	feature := &Feature{
+		Type: "Feature",
+		ID:   p.ID,
+		Properties: FeatureProperties{
+			File:        p.File,
+			Thumbnail:   p.Thumbnail(),
+			Description: p.Description,
+			TakenAt:     p.TakenAt,
+		},
+	}
+	if p.Latitude != nil && p.Longitude != nil {
+		feature.Geometry = &Point{Type: "Point", Coordinates: [2]float64{*p.Longitude, *p.Latitude}}
+	}
+	return feature
+}
+
+// NewFeatureCollection Turn photos into a GeoJSON FeatureCollection
+func NewFeatureCollection[T interface{ Feature() *Feature }](photos []T) *FeatureCollection {
+	collection := &FeatureCollection{Type: "FeatureCollection", Features: make([]*Feature, 0, len(photos))}
+	for _, photo := range photos {
+		collection.Features = append(collection.Features, photo.Feature())
+	}
+	return collection
+}
+
+// sendPhotos Send photos as GeoJSON if it was asked for, otherwise as usual
+func sendPhotos(w http.ResponseWriter, r *http.Request, photos []*Photo) {
+	if WantsGeoJSON(r) {
+		responses.GeoJSON(w, r, NewFeatureCollection(photos))
+		return
+	}
+	responses.StructOK(w, r, photos)
+}
+
+// ------------------- Handlers -------------------
+
+// GetPhotosNear Get the photos taken within radius_km of lat and lon
+func GetPhotosNear(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lat, err := QueryFloat(r, "lat")
+		if err != nil {
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		lon, err := QueryFloat(r, "lon")
+		if err != nil {
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		radius, err := QueryFloat(r, "radius_km")
+		if err != nil {
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		amount, err := QueryInt(r, "amount", DefaultGeoAmount)
+		if err != nil || amount < 0 {
+			log.Println("invalid amount", err)
+			responses.BadRequest(w, r, "invalid amount")
+			return
+		}
+
+		photos, status, err := s.GetPhotosNear(lat, lon, radius, amount)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		if WantsGeoJSON(r) {
+			collection := &FeatureCollection{Type: "FeatureCollection", Features: make([]*Feature, 0, len(photos))}
+			for _, photo := range photos {
+				feature := photo.Feature()
+				feature.Properties.DistanceKm = &photo.DistanceKm
+				collection.Features = append(collection.Features, feature)
+			}
+			responses.GeoJSON(w, r, collection)
+			return
+		}
+		responses.StructOK(w, r, photos)
+	}
+}
+
+// GetPhotosInBox Get the photos taken inside bbox=west,south,east,north
+func GetPhotosInBox(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		box, err := ParseBoundingBox(r.URL.Query().Get("bbox"))
+		if err != nil {
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		amount, err := QueryInt(r, "amount", DefaultGeoAmount)
+		if err != nil || amount < 0 {
+			log.Println("invalid amount", err)
+			responses.BadRequest(w, r, "invalid amount")
+			return
+		}
+
+		photos, status, err := s.GetPhotosInBox(box, amount)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		sendPhotos(w, r, photos)
+	}
+}
@@ -0,0 +1,279 @@
+package photodump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"home_api/src/database"
+	"home_api/src/responses"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// HistoryAction What was done to a photo
+type HistoryAction string
+
+const (
+	HistoryEdit    HistoryAction = "edit"
+	HistoryRevert  HistoryAction = "revert"
+	HistoryDelete  HistoryAction = "delete"
+	HistoryRestore HistoryAction = "restore"
+)
+
+// FieldChange What a field was before and after a change, as JSON
+type FieldChange struct {
+	From json.RawMessage `json:"from"`
+	To   json.RawMessage `json:"to"`
+}
+
+// HistoryEntry A change made to a photo, and who made it.
+// There are no accounts, so who is the address the request came from.
+type HistoryEntry struct {
+	ID        string                 `json:"id" db:"id"`
+	PhotoID   string                 `json:"photo_id" db:"photo_id"`
+	Action    HistoryAction          `json:"action" db:"action"`
+	Actor     string                 `json:"actor" db:"actor"`
+	Changes   map[string]FieldChange `json:"changes" db:"changes"`
+	CreatedAt time.Time              `json:"created_at" db:"created_at"`
+}
+
+// ------------------- Store -------------------
+
+// CreateHistoryEntry Add an entry to the history of a photo
+func (s *store) CreateHistoryEntry(e *HistoryEntry) error {
+	_, err := s.db.Exec(context.Background(), `
+INSERT INTO photo_history (id, photo_id, action, actor, changes, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+		e.ID, e.PhotoID, e.Action, e.Actor, e.Changes, e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPhotoHistory Get the history of a photo, newest first
+func (s *store) GetPhotoHistory(photoID string) ([]*HistoryEntry, error) {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT * FROM photo_history WHERE photo_id = $1 ORDER BY created_at DESC, id DESC", photoID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[HistoryEntry])
+}
+
+// ------------------- Service -------------------
+
+// recordHistory Add an entry to the history of a photo, a failure is logged rather than undoing the change
+func (s *service) recordHistory(photoID string, action HistoryAction, actor string, changes map[string]FieldChange) {
+	id, err := database.GenSnowflake()
+	if err != nil {
+		log.Println("could not generate id for history. ID: "+photoID, err)
+		return
+	}
+	if changes == nil {
+		changes = make(map[string]FieldChange)
+	}
+	err = s.ps.CreateHistoryEntry(&HistoryEntry{
+		ID:        id,
+		PhotoID:   photoID,
+		Action:    action,
+		Actor:     actor,
+		Changes:   changes,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Println("could not record history. ID: "+photoID+" Action: "+string(action), err)
+	}
+}
+
+// GetPhotoHistory Get the history of a photo, newest first.
+// The history outlives the photo, so it's there for photos in the trash and ones that have been purged.
+func (s *service) GetPhotoHistory(id string) ([]*HistoryEntry, int, error) {
+	history, err := s.ps.GetPhotoHistory(id)
+	if err != nil {
+		log.Println("could not get photo history. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photo history")
+	}
+	if len(history) > 0 {
+		return history, http.StatusOK, nil
+	}
+	_, err = s.ps.GetPhotoById(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("photo does not exist")
+	}
+	if err != nil {
+		log.Println("could not get photo. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photo")
+	}
+	return history, http.StatusOK, nil
+}
+
+// RevertPhoto Put the editable fields of a photo back to how they were before a change in its history,
+// undoing that change and every one since. The revert is recorded in the history like any other edit.
+func (s *service) RevertPhoto(id string, entryID string, actor string) (*Photo, int, error) {
+	photo, status, err := s.GetPhotoById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	history, status, err := s.GetPhotoHistory(id)
+	if err != nil {
+		return nil, status, err
+	}
+
+	// Walking back from the newest change, the last value seen for each field is the one from before the entry
+	fields := make(map[string]json.RawMessage)
+	found := false
+	for _, entry := range history {
+		for field, change := range entry.Changes {
+			fields[field] = change.From
+		}
+		if entry.ID == entryID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, http.StatusNotFound, errors.New("history entry does not exist")
+	}
+	// The time, where it came from and its offset go together, so the ones that weren't changed are filled in
+	current := editableFields(photo)
+	timeFields := []string{"taken_at", "taken_at_source", "taken_at_offset"}
+	if slices.ContainsFunc(timeFields, func(field string) bool { return fields[field] != nil }) {
+		for _, field := range timeFields {
+			if fields[field] == nil {
+				fields[field] = current[field]
+			}
+		}
+	}
+	patch, err := patchFromFields(fields)
+	if err != nil {
+		log.Println("could not read photo history. ID: "+id+" Entry: "+entryID, err)
+		return nil, http.StatusInternalServerError, errors.New("could not read photo history")
+	}
+	status, err = s.savePatch(photo, patch, actor, HistoryRevert)
+	if err != nil {
+		return nil, status, err
+	}
+	return photo, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// editableFields The fields that edits change, as JSON, keyed like they are in the history
+func editableFields(p *Photo) map[string]json.RawMessage {
+	// An empty list has to read the same whether or not it's nil, or it would look like a change
+	p.EnsureNonNil()
+	fields := make(map[string]json.RawMessage)
+	for field, value := range map[string]any{
+		"description":     p.Description,
+		"source":          p.Source,
+		"subjects":        p.Subjects,
+		"tags":            p.Tags,
+		"people":          p.People,
+		"regions":         p.Regions,
+		"taken_at":        p.TakenAt,
+		"taken_at_source": p.TakenAtSource,
+		"taken_at_offset": p.TakenAtOffset,
+	} {
+		bs, err := json.Marshal(value)
+		if err != nil {
+			log.Println("could not encode field. ID: "+p.ID+" Field: "+field, err)
+			continue
+		}
+		fields[field] = bs
+	}
+	return fields
+}
+
+// diffFields The fields that differ between two sets of editable fields
+func diffFields(before map[string]json.RawMessage, after map[string]json.RawMessage) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	for field, to := range after {
+		from := before[field]
+		if !bytes.Equal(from, to) {
+			changes[field] = FieldChange{From: from, To: to}
+		}
+	}
+	return changes
+}
+
+// patchFromFields A patch that puts the fields back to the JSON values from the history.
+// People aren't set, they're worked out again from the subjects and regions.
+func patchFromFields(fields map[string]json.RawMessage) (*PhotoPatch, error) {
+	patch := &PhotoPatch{Revert: true}
+	var err error
+	for field, value := range fields {
+		switch field {
+		case "description":
+			patch.Description = new(string)
+			err = json.Unmarshal(value, patch.Description)
+		case "source":
+			patch.Source = new(string)
+			err = json.Unmarshal(value, patch.Source)
+		case "subjects":
+			patch.Subjects = &[]string{}
+			err = json.Unmarshal(value, patch.Subjects)
+		case "tags":
+			patch.Tags = &[]string{}
+			err = json.Unmarshal(value, patch.Tags)
+		case "regions":
+			patch.Regions = &[]Region{}
+			err = json.Unmarshal(value, patch.Regions)
+		case "taken_at":
+			patch.TakenAt = new(time.Time)
+			err = json.Unmarshal(value, patch.TakenAt)
+		case "taken_at_source":
+			err = json.Unmarshal(value, &patch.TakenAtSource)
+		case "taken_at_offset":
+			err = json.Unmarshal(value, &patch.TakenAtOffset)
+		}
+		if err != nil {
+			return nil, errors.New("invalid " + field + ": " + err.Error())
+		}
+	}
+	return patch, nil
+}
+
+// requestActor Who made a request, as far as the server can tell
+func requestActor(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ------------------- Handlers -------------------
+
+// GetPhotoHistory Get the history of the photo in the path
+func GetPhotoHistory(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history, status, err := s.GetPhotoHistory(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, history)
+	}
+}
+
+// RevertPhoto Undo the change in the path to the photo in the path, and every change since
+func RevertPhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		photo, status, err := s.RevertPhoto(r.PathValue("id"), r.PathValue("entry"), requestActor(r))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		w.Header().Set("ETag", photo.ETag())
+		responses.StructOK(w, r, photo)
+	}
+}
@@ -0,0 +1,491 @@
+package photodump
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"home_api/src/database"
+	"home_api/src/responses"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/minio/minio-go/v7"
+)
+
+// ------------------- Types -------------------
+
+// JobKind The kind of background processing a job performs
+type JobKind string
+
+const (
+	// DerivativesJob Generate the resized WebP derivatives of a photo
+	DerivativesJob JobKind = "derivatives"
+	// MetadataJob Extract the Exiv2 metadata of a photo
+	MetadataJob JobKind = "metadata"
+	// RehashJob Recompute the hashes and resolution of a photo from the stored original
+	RehashJob JobKind = "rehash"
+	// RenditionJob Encode a full size copy of a photo that browsers can display
+	RenditionJob JobKind = "rendition"
+)
+
+// Valid Whether the kind is one of the known job kinds
+func (k JobKind) Valid() bool {
+	switch k {
+	case DerivativesJob, MetadataJob, RehashJob, RenditionJob:
+		return true
+	}
+	return false
+}
+
+// JobStatus The state of a job in the queue
+type JobStatus string
+
+const (
+	JobPending JobStatus = "pending"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job A unit of background processing for a photo.
+// While a job is running RunAt is when its lease runs out, after which another worker can claim it.
+type Job struct {
+	ID          string    `json:"id" db:"id"`
+	PhotoID     string    `json:"photo_id" db:"photo_id"`
+	Kind        JobKind   `json:"kind" db:"kind"`
+	Status      JobStatus `json:"status" db:"status"`
+	Attempts    int       `json:"attempts" db:"attempts"`
+	MaxAttempts int       `json:"max_attempts" db:"max_attempts"`
+	LastError   string    `json:"last_error,omitempty" db:"last_error"`
+	RunAt       time.Time `json:"run_at" db:"run_at"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// JobMaxAttempts How many times a job is tried before it's marked as failed
+const JobMaxAttempts = 5
+
+// JobPollInterval How often idle workers check the queue for new jobs
+const JobPollInterval = 5 * time.Second
+
+// JobLease How long a claimed job is hidden from other workers, it's renewed while the job runs
+const JobLease = 5 * time.Minute
+
+// jobBackoff How long to wait before retrying a job that has failed the given number of times
+func jobBackoff(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * 30 * time.Second
+}
+
+// -------------- Globals --------------
+
+// metadataJobFields The editable fields the metadata job writes, keyed like they are in the history
+var metadataJobFields = []string{"taken_at", "taken_at_source", "taken_at_offset", "regions", "people"}
+
+var jobWorkers = func() int {
+	workers, err := strconv.Atoi(os.Getenv("PHOTO_JOB_WORKERS"))
+	if err != nil || workers < 1 {
+		return 2
+	}
+	return workers
+}()
+
+// ------------------- Store -------------------
+
+const insertJobQuery = `
+INSERT INTO photo_jobs
+(id, photo_id, kind, status, attempts, max_attempts,
+last_error, run_at, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+// CreateJob Add a job to the queue
+func (s *store) CreateJob(j *Job) error {
+	_, err := s.db.Exec(context.Background(), insertJobQuery,
+		j.ID, j.PhotoID, j.Kind, j.Status, j.Attempts, j.MaxAttempts,
+		j.LastError, j.RunAt, j.CreatedAt, j.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetJobsByPhoto Get all the jobs for a photo, newest first
+func (s *store) GetJobsByPhoto(photoID string) ([]*Job, error) {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT * FROM photo_jobs WHERE photo_id = $1 ORDER BY created_at DESC", photoID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Job])
+}
+
+// claimJobQuery Running jobs whose lease has run out belong to a worker that's gone, so they're claimed like pending ones
+const claimJobQuery = `
+UPDATE photo_jobs SET status = 'running', attempts = attempts + 1,
+run_at = NOW() + $1 * INTERVAL '1 second', updated_at = NOW()
+WHERE id = (
+	SELECT id FROM photo_jobs
+	WHERE status IN ('pending', 'running') AND run_at <= NOW()
+	ORDER BY run_at
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED)
+RETURNING *`
+
+// ClaimJob Take the next job that's due off the queue, leasing it while it runs, returning nil if there isn't one
+func (s *store) ClaimJob() (*Job, error) {
+	rows, _ := s.db.Query(context.Background(), claimJobQuery, JobLease.Seconds())
+	job, err := pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[Job])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// UpdateJob Update the status of a job, unless another worker has claimed it since
+func (s *store) UpdateJob(j *Job) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE photo_jobs SET status = $2, last_error = $3, run_at = $4, updated_at = NOW() WHERE id = $1 AND attempts = $5",
+		j.ID, j.Status, j.LastError, j.RunAt, j.Attempts)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenewJobLease Push back the lease on a running job, unless another worker has claimed it since
+func (s *store) RenewJobLease(j *Job) error {
+	_, err := s.db.Exec(context.Background(), `
+UPDATE photo_jobs SET run_at = NOW() + $3 * INTERVAL '1 second', updated_at = NOW()
+WHERE id = $1 AND attempts = $2 AND status = 'running'`,
+		j.ID, j.Attempts, JobLease.Seconds())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPhotoFromS3 Download the original of a photo from S3
+func (s *store) GetPhotoFromS3(photo *Photo) ([]byte, error) {
+	obj, err := s.s3.GetObject(
+		context.Background(), "photos", photo.ID+"."+photo.Ext,
+		minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// UpdatePhotoDerivatives Update only the derivatives of a Photo in the database,
+// as long as its original hasn't moved since they were generated. Returns whether it was updated.
+func (s *store) UpdatePhotoDerivatives(p *Photo) (bool, error) {
+	p.EnsureNonNil()
+	tag, err := s.db.Exec(context.Background(),
+		"UPDATE photos SET derivatives = $2 WHERE id = $1 AND file = $3 AND deleted_at IS NULL",
+		p.ID, p.Derivatives, p.File)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// UpdatePhotoHashes Update only the hashes and resolution of a Photo in the database
+func (s *store) UpdatePhotoHashes(p *Photo) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE photos SET hash = $2, phash = $3, phashes = $4, resolution = $5 WHERE id = $1",
+		p.ID, p.Hash, p.PHash, p.PHashes, p.Resolution)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ------------------- Service -------------------
+
+// QueuePhotoJob Add a job for a photo to the queue
+func (s *service) QueuePhotoJob(photoID string, kind JobKind) (*Job, int, error) {
+	if !kind.Valid() {
+		return nil, http.StatusBadRequest, errors.New("invalid job kind: " + string(kind))
+	}
+	id, err := database.GenSnowflake()
+	if err != nil {
+		log.Println("could not generate id", err)
+		return nil, http.StatusInternalServerError, errors.New("could not generate id")
+	}
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		PhotoID:     photoID,
+		Kind:        kind,
+		Status:      JobPending,
+		MaxAttempts: JobMaxAttempts,
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	err = s.ps.CreateJob(job)
+	if err != nil {
+		log.Println("could not queue job. ID: "+photoID+" Kind: "+string(kind), err)
+		return nil, http.StatusInternalServerError, errors.New("could not queue job")
+	}
+	// Wake an idle worker, unless one is already being woken
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	log.Println("queued job. ID: " + photoID + " Kind: " + string(kind))
+	return job, http.StatusCreated, nil
+}
+
+// GetPhotoJobs Get the jobs that have been queued for a photo
+func (s *service) GetPhotoJobs(photoID string) ([]*Job, int, error) {
+	jobs, err := s.ps.GetJobsByPhoto(photoID)
+	if err != nil {
+		log.Println("could not get jobs. ID: "+photoID, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get jobs")
+	}
+	return jobs, http.StatusOK, nil
+}
+
+// RunJobs Process queued jobs and object deletions, and purge expired trash, until the context is cancelled.
+// Jobs interrupted by a restart are picked up again once their lease runs out.
+func (s *service) RunJobs(ctx context.Context) {
+	for range jobWorkers {
+		go s.jobWorker(ctx)
+	}
+	go s.outboxWorker(ctx)
+	go s.trashPurger(ctx)
+}
+
+// jobWorker Run jobs one at a time, sleeping when the queue is empty
+func (s *service) jobWorker(ctx context.Context) {
+	ticker := time.NewTicker(JobPollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going while there's work, only waiting once the queue is drained
+		for s.runNextJob() {
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNextJob Claim and run the next job, returning whether there was one
+func (s *service) runNextJob() bool {
+	job, err := s.ps.ClaimJob()
+	if err != nil {
+		log.Println("could not claim job", err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+
+	done := make(chan struct{})
+	go s.renewJobLease(job, done)
+	err = s.processJob(job)
+	close(done)
+	if err == nil {
+		job.Status = JobDone
+		job.LastError = ""
+		log.Println("job done. ID: " + job.PhotoID + " Kind: " + string(job.Kind))
+	} else if job.Attempts >= job.MaxAttempts {
+		job.Status = JobFailed
+		job.LastError = err.Error()
+		log.Println("job failed. ID: "+job.PhotoID+" Kind: "+string(job.Kind), err)
+	} else {
+		job.Status = JobPending
+		job.LastError = err.Error()
+		job.RunAt = time.Now().Add(jobBackoff(job.Attempts))
+		log.Println("job will be retried. ID: "+job.PhotoID+" Kind: "+string(job.Kind), err)
+	}
+	err = s.ps.UpdateJob(job)
+	if err != nil {
+		log.Println("could not update job. ID: "+job.PhotoID+" Kind: "+string(job.Kind), err)
+	}
+	return true
+}
+
+// renewJobLease Keep the lease on a job from running out until done is closed
+func (s *service) renewJobLease(job *Job, done chan struct{}) {
+	ticker := time.NewTicker(JobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := s.ps.RenewJobLease(job)
+			if err != nil {
+				log.Println("could not renew job lease. ID: "+job.PhotoID+" Kind: "+string(job.Kind), err)
+			}
+		}
+	}
+}
+
+// processJob Do the work for a job
+func (s *service) processJob(job *Job) error {
+	photo, err := s.ps.GetPhotoById(job.PhotoID)
+	if err != nil {
+		return errors.New("could not get photo: " + err.Error())
+	}
+	if photo.DeletedAt != nil {
+		// The original has moved, restoring the photo queues what it needs again
+		log.Println("skipping job for trashed photo. ID: " + photo.ID + " Kind: " + string(job.Kind))
+		return nil
+	}
+	bs, err := s.ps.GetPhotoFromS3(photo)
+	if err != nil {
+		return errors.New("could not download photo from S3: " + err.Error())
+	}
+
+	switch job.Kind {
+	case DerivativesJob:
+		img, ext, err := DecodeImage(bytes.NewReader(bs), DetectImageType(bs))
+		if err != nil {
+			return err
+		}
+		err = s.ps.DeleteDerivativesFromS3(photo)
+		if err != nil {
+			return errors.New("could not remove old derivatives from S3: " + err.Error())
+		}
+		err = s.GenerateDerivatives(photo, Orient(img, ImageOrientation(ext, bs)))
+		if err != nil {
+			return err
+		}
+		updated, err := s.ps.UpdatePhotoDerivatives(photo)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return errors.New("photo was moved while its derivatives were generated")
+		}
+		return nil
+	case MetadataJob:
+		// An edit made while the file was read wins, the job is retried to read it again on top of the edit
+		modifiedAt := photo.ModifiedAt
+		before := editableFields(photo)
+		err = photo.GetExivData(bs)
+		if err != nil {
+			return err
+		}
+		_, err = linkPeople(photo, s.GetPeople())
+		if err != nil {
+			return err
+		}
+		updated, err := s.ps.UpdatePhotoMetadata(photo, modifiedAt)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return errors.New("photo was edited or moved while its metadata was read")
+		}
+		changes := diffFields(before, editableFields(photo))
+		maps.DeleteFunc(changes, func(field string, _ FieldChange) bool {
+			return !slices.Contains(metadataJobFields, field)
+		})
+		if len(changes) > 0 {
+			s.recordHistory(photo.ID, HistoryEdit, "metadata", changes)
+		}
+		return nil
+	case RehashJob:
+		// The extension is part of the object name, so it can't change after upload
+		ext := photo.Ext
+		_, _, err = photo.GetImgData(bytes.NewReader(bs), bs, DetectImageType(bs))
+		photo.Ext = ext
+		if err != nil {
+			return err
+		}
+		return s.ps.UpdatePhotoHashes(photo)
+	case RenditionJob:
+		img, ext, err := DecodeImage(bytes.NewReader(bs), DetectImageType(bs))
+		if err != nil {
+			return err
+		}
+		err = s.ps.DeleteRenditionFromS3(photo)
+		if err != nil {
+			return errors.New("could not remove old rendition from S3: " + err.Error())
+		}
+		photo.Rendition = ""
+		err = s.GenerateRendition(photo, Orient(img, ImageOrientation(ext, bs)))
+		if err != nil {
+			return err
+		}
+		updated, err := s.ps.UpdatePhotoRendition(photo)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return errors.New("photo was moved while its rendition was generated")
+		}
+		return nil
+	}
+	return errors.New("unknown job kind: " + string(job.Kind))
+}
+
+// ------------------- Handlers -------------------
+
+// GetPhotoJobs Get the status of the background jobs for a photo
+func GetPhotoJobs(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			responses.BadRequest(w, r, "no ID in the query")
+			return
+		}
+		_, status, err := s.GetPhotoById(id)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		jobs, status, err := s.GetPhotoJobs(id)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, jobs)
+	}
+}
+
+// QueuePhotoJob Queue a background job for a photo, eg. to rehash photos uploaded before a change
+func QueuePhotoJob(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			responses.BadRequest(w, r, "no ID in the query")
+			return
+		}
+		kind := r.URL.Query().Get("kind")
+		if kind == "" {
+			responses.BadRequest(w, r, "no kind in the query")
+			return
+		}
+		_, status, err := s.GetPhotoById(id)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		job, status, err := s.QueuePhotoJob(id, JobKind(kind))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructCreated(w, r, job)
+	}
+}
@@ -0,0 +1,323 @@
+package photodump
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// ------------------- Types -------------------
+
+// jpegSegment A marker segment from the header of a JPEG, without its length
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+// -------------- Globals --------------
+
+const (
+	jpegAPP0  = 0xE0
+	jpegAPP1  = 0xE1
+	jpegAPP13 = 0xED
+	jpegSOS   = 0xDA
+	jpegEOI   = 0xD9
+)
+
+// jpegMaxSegment The most data a JPEG segment can hold, its length also counts the two bytes of itself
+const jpegMaxSegment = 0xFFFF - 2
+
+// jpegXmpHeader The identifier at the start of the APP1 segment holding the XMP packet
+const jpegXmpHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+// jpegPhotoshopHeader The identifier at the start of the APP13 segment holding the IPTC data
+const jpegPhotoshopHeader = "Photoshop 3.0\x00"
+
+// iptcResource The ID of the Photoshop image resource holding the IPTC data
+const iptcResource = 0x0404
+
+// iptcKeywordSize The most bytes an IPTC keyword can be
+const iptcKeywordSize = 64
+
+// xmpPacketStart The start of a new XMP packet, the rdf:Description goes between it and xmpPacketEnd
+const xmpPacketStart = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`
+const xmpPacketEnd = "</rdf:RDF></x:xmpmeta>\n<?xpacket end=\"w\"?>"
+
+// ------------------- Functions -------------------
+
+// embedJPEGMetadata Write what goexiv can't into a JPEG: every keyword as its own IPTC dataset,
+// and the XMP description added to the packet, which is created if the file doesn't have one.
+// XMP that won't fit in a segment is left out, the EXIF and IPTC still have the same fields.
+func embedJPEGMetadata(bs []byte, keywords []string, description string) ([]byte, error) {
+	segments, rest, err := splitJPEG(bs)
+	if err != nil {
+		return nil, err
+	}
+	iptcDone, xmpDone := false, description == ""
+	for i, segment := range segments {
+		switch {
+		case !iptcDone && segment.marker == jpegAPP13 && bytes.HasPrefix(segment.data, []byte(jpegPhotoshopHeader)):
+			resources, err := setResourceKeywords(segment.data[len(jpegPhotoshopHeader):], keywords)
+			if err != nil {
+				return nil, err
+			}
+			segments[i].data = append([]byte(jpegPhotoshopHeader), resources...)
+			iptcDone = true
+		case !xmpDone && segment.marker == jpegAPP1 && bytes.HasPrefix(segment.data, []byte(jpegXmpHeader)):
+			packet := segment.data[len(jpegXmpHeader):]
+			end := bytes.LastIndex(packet, []byte("</rdf:RDF>"))
+			if end < 0 {
+				return nil, errors.New("XMP packet has no rdf:RDF element")
+			}
+			xmpDone = true
+			if len(segment.data)+len(description) > jpegMaxSegment {
+				log.Println("XMP packet is too large to add the description to, leaving it as it was")
+				continue
+			}
+			data := append([]byte(jpegXmpHeader), packet[:end]...)
+			data = append(data, description...)
+			segments[i].data = append(data, packet[end:]...)
+		}
+	}
+
+	// New segments go after the JFIF and EXIF ones, which readers expect first
+	at := 0
+	for at < len(segments) && (segments[at].marker == jpegAPP0 || segments[at].marker == jpegAPP1) {
+		at++
+	}
+	if !xmpDone && len(jpegXmpHeader+xmpPacketStart+description+xmpPacketEnd) > jpegMaxSegment {
+		log.Println("XMP description is too large for a JPEG, leaving it out")
+		xmpDone = true
+	}
+	if !xmpDone {
+		packet := jpegXmpHeader + xmpPacketStart + description + xmpPacketEnd
+		segments = append(segments[:at], append([]jpegSegment{{jpegAPP1, []byte(packet)}}, segments[at:]...)...)
+		at++
+	}
+	if !iptcDone && len(keywords) > 0 {
+		resources, err := setResourceKeywords(nil, keywords)
+		if err != nil {
+			return nil, err
+		}
+		data := append([]byte(jpegPhotoshopHeader), resources...)
+		segments = append(segments[:at], append([]jpegSegment{{jpegAPP13, data}}, segments[at:]...)...)
+	}
+	return joinJPEG(segments, rest)
+}
+
+// splitJPEG Split a JPEG into the marker segments of its header, and the rest from the start of the scan
+func splitJPEG(bs []byte) ([]jpegSegment, []byte, error) {
+	if len(bs) < 2 || bs[0] != 0xFF || bs[1] != 0xD8 {
+		return nil, nil, errors.New("not a JPEG")
+	}
+	segments := make([]jpegSegment, 0)
+	for i := 2; ; {
+		// Markers can be padded with any number of fill bytes
+		for i+1 < len(bs) && bs[i] == 0xFF && bs[i+1] == 0xFF {
+			i++
+		}
+		if i+2 > len(bs) || bs[i] != 0xFF {
+			return nil, nil, errors.New("invalid JPEG marker")
+		}
+		marker := bs[i+1]
+		if marker == jpegSOS || marker == jpegEOI {
+			return segments, bs[i:], nil
+		}
+		if i+4 > len(bs) {
+			return nil, nil, errors.New("JPEG ends in a marker")
+		}
+		size := int(binary.BigEndian.Uint16(bs[i+2:]))
+		if size < 2 || i+2+size > len(bs) {
+			return nil, nil, errors.New("JPEG segment runs past the end of the file")
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: bs[i+4 : i+2+size]})
+		i += 2 + size
+	}
+}
+
+// joinJPEG Put a JPEG back together from the segments of its header and the rest of it
+func joinJPEG(segments []jpegSegment, rest []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8})
+	for _, segment := range segments {
+		if len(segment.data) > jpegMaxSegment {
+			return nil, errors.New("JPEG segment is too large")
+		}
+		buf.Write([]byte{0xFF, segment.marker})
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(segment.data)+2)))
+		buf.Write(segment.data)
+	}
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
+// setResourceKeywords Replace the keywords in the IPTC data of a block of Photoshop image resources,
+// adding the IPTC resource if there isn't one
+func setResourceKeywords(resources []byte, keywords []string) ([]byte, error) {
+	out := make([]byte, 0, len(resources))
+	found := false
+	for i := 0; i < len(resources); {
+		// Each resource is "8BIM", its ID, its name as a Pascal string, then its size and data, both padded to even
+		if i+7 > len(resources) || string(resources[i:i+4]) != "8BIM" {
+			return nil, errors.New("invalid Photoshop image resource")
+		}
+		id := binary.BigEndian.Uint16(resources[i+4:])
+		nameSize := int(resources[i+6]) + 1
+		at := i + 6 + nameSize + nameSize%2
+		if at+4 > len(resources) {
+			return nil, errors.New("invalid Photoshop image resource")
+		}
+		size := int(binary.BigEndian.Uint32(resources[at:]))
+		end := at + 4 + size
+		if end > len(resources) {
+			return nil, errors.New("Photoshop image resource runs past the end of the segment")
+		}
+		next := min(end+size%2, len(resources))
+		if found || id != iptcResource {
+			out = append(out, resources[i:next]...)
+			i = next
+			continue
+		}
+		found = true
+		iim, err := setIIMKeywords(resources[at+4:end], keywords)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, resources[i:at]...)
+		out = appendResourceData(out, iim)
+		i = next
+	}
+	if !found {
+		iim, err := setIIMKeywords(nil, keywords)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, "8BIM"...)
+		out = binary.BigEndian.AppendUint16(out, iptcResource)
+		// An empty name, padded to even
+		out = append(out, 0, 0)
+		out = appendResourceData(out, iim)
+	}
+	return out, nil
+}
+
+// appendResourceData Append the size and data of a Photoshop image resource, padded to even
+func appendResourceData(out []byte, data []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// setIIMKeywords Replace the Keywords datasets in IPTC IIM data, one per keyword,
+// keeping the datasets in the order the standard asks for
+func setIIMKeywords(iim []byte, keywords []string) ([]byte, error) {
+	const record, dataset = 2, 25
+	out := make([]byte, 0, len(iim))
+	added := false
+	add := func() {
+		for _, keyword := range keywords {
+			keyword = truncateUTF8(keyword, iptcKeywordSize)
+			out = append(out, 0x1C, record, dataset)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(keyword)))
+			out = append(out, keyword...)
+		}
+		added = true
+	}
+	// Each dataset is a tag marker, its record and dataset numbers, then its size and data
+	for i := 0; i < len(iim) && iim[i] == 0x1C; {
+		if i+5 > len(iim) {
+			return nil, errors.New("invalid IPTC dataset")
+		}
+		r, d := iim[i+1], iim[i+2]
+		size := int(binary.BigEndian.Uint16(iim[i+3:]))
+		start := i + 5
+		// Extended datasets give how many of the following bytes hold their size
+		if size&0x8000 != 0 {
+			n := size & 0x7FFF
+			if n > 4 || start+n > len(iim) {
+				return nil, errors.New("invalid IPTC dataset")
+			}
+			size = 0
+			for _, b := range iim[start : start+n] {
+				size = size<<8 | int(b)
+			}
+			start += n
+		}
+		end := start + size
+		if end > len(iim) {
+			return nil, errors.New("IPTC dataset runs past the end of its resource")
+		}
+		if !added && (r > record || r == record && d > dataset) {
+			add()
+		}
+		if r != record || d != dataset {
+			out = append(out, iim[i:end]...)
+		}
+		i = end
+	}
+	if !added {
+		add()
+	}
+	return out, nil
+}
+
+// truncateUTF8 Cut a string down to at most size bytes without splitting a character
+func truncateUTF8(s string, size int) string {
+	if len(s) <= size {
+		return s
+	}
+	for size > 0 && !utf8.RuneStart(s[size]) {
+		size--
+	}
+	return s[:size]
+}
+
+// xmpDescription The fields written to the XMP on download as an rdf:Description,
+// or an empty string if there aren't any
+func (p *Photo) xmpDescription(keywords []string) string {
+	var b strings.Builder
+	if p.Description != "" {
+		b.WriteString(`<dc:description><rdf:Alt><rdf:li xml:lang="x-default">` + xmlText(p.Description) +
+			`</rdf:li></rdf:Alt></dc:description>`)
+	}
+	if len(keywords) > 0 {
+		b.WriteString(`<dc:subject><rdf:Bag>`)
+		for _, keyword := range keywords {
+			b.WriteString(`<rdf:li>` + xmlText(keyword) + `</rdf:li>`)
+		}
+		b.WriteString(`</rdf:Bag></dc:subject>`)
+	}
+	if p.Source != "" {
+		b.WriteString(`<photoshop:Source>` + xmlText(p.Source) + `</photoshop:Source>`)
+	}
+	if !p.TakenAt.IsZero() {
+		taken := p.LocalTakenAt().Format("2006-01-02T15:04:05")
+		if p.TakenAtOffset != nil {
+			taken += p.LocalTakenAt().Format("-07:00")
+		}
+		b.WriteString(`<photoshop:DateCreated>` + taken + `</photoshop:DateCreated>`)
+		b.WriteString(`<exif:DateTimeOriginal>` + taken + `</exif:DateTimeOriginal>`)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return `<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"` +
+		` xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/" xmlns:exif="http://ns.adobe.com/exif/1.0/">` +
+		b.String() + `</rdf:Description>`
+}
+
+// xmlText Escape a value for the text of an XML element
+func xmlText(s string) string {
+	var b strings.Builder
+	// Writing to a strings.Builder can't fail
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
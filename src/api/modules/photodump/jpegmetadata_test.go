@@ -0,0 +1,341 @@
+package photodump
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scan The start of scan and the end of image, everything splitJPEG leaves alone
+var scan = []byte{0xFF, jpegSOS, 0x00, 0x04, 0x01, 0x02, 0xAB, 0xCD, 0xFF, jpegEOI}
+
+// testJPEG A JPEG with the given segments before the scan
+func testJPEG(t *testing.T, segments ...jpegSegment) []byte {
+	t.Helper()
+	bs, err := joinJPEG(segments, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+// testResource A Photoshop image resource with a name and data, padded like Photoshop writes them
+func testResource(id uint16, name string, data []byte) []byte {
+	res := []byte("8BIM")
+	res = append(res, byte(id>>8), byte(id))
+	res = append(res, byte(len(name)))
+	res = append(res, name...)
+	if (len(name)+1)%2 == 1 {
+		res = append(res, 0)
+	}
+	return appendResourceData(res, data)
+}
+
+// testDataset An IPTC IIM dataset
+func testDataset(record byte, dataset byte, value string) []byte {
+	return append([]byte{0x1C, record, dataset, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+// testKeywords The values of the Keywords datasets in IPTC IIM data
+func testKeywords(t *testing.T, iim []byte) []string {
+	t.Helper()
+	keywords := make([]string, 0)
+	for i := 0; i < len(iim); {
+		if i+5 > len(iim) || iim[i] != 0x1C {
+			t.Fatalf("invalid dataset at %d: %q", i, iim)
+		}
+		size := int(iim[i+3])<<8 | int(iim[i+4])
+		if iim[i+1] == 2 && iim[i+2] == 25 {
+			keywords = append(keywords, string(iim[i+5:i+5+size]))
+		}
+		i += 5 + size
+	}
+	return keywords
+}
+
+func TestSplitJPEG(t *testing.T) {
+	app0 := []byte{0xFF, jpegAPP0, 0x00, 0x05, 'J', 'F', 'I'}
+	tests := []struct {
+		name     string
+		bs       []byte
+		segments []jpegSegment
+		wantErr  bool
+	}{
+		{"no segments", slices.Concat([]byte{0xFF, 0xD8}, scan), []jpegSegment{}, false},
+		{"one segment", slices.Concat([]byte{0xFF, 0xD8}, app0, scan),
+			[]jpegSegment{{jpegAPP0, []byte("JFI")}}, false},
+		{"fill bytes", slices.Concat([]byte{0xFF, 0xD8, 0xFF, 0xFF}, app0, []byte{0xFF}, scan),
+			[]jpegSegment{{jpegAPP0, []byte("JFI")}}, false},
+		{"empty segment", slices.Concat([]byte{0xFF, 0xD8, 0xFF, jpegAPP13, 0x00, 0x02}, scan),
+			[]jpegSegment{{jpegAPP13, []byte{}}}, false},
+		{"not a JPEG", []byte("GIF89a"), nil, true},
+		{"empty", []byte{}, nil, true},
+		{"segment past the end", []byte{0xFF, 0xD8, 0xFF, jpegAPP0, 0x00, 0x10, 'J'}, nil, true},
+		{"segment too short", slices.Concat([]byte{0xFF, 0xD8, 0xFF, jpegAPP0, 0x00, 0x01}, scan), nil, true},
+		{"ends in a marker", []byte{0xFF, 0xD8, 0xFF, jpegAPP0, 0x00}, nil, true},
+		{"no scan", slices.Concat([]byte{0xFF, 0xD8}, app0), nil, true},
+		{"garbage between segments", slices.Concat([]byte{0xFF, 0xD8}, app0, []byte{0x00}, scan), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, rest, err := splitJPEG(tt.bs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitJPEG() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !slices.EqualFunc(segments, tt.segments, func(a, b jpegSegment) bool {
+				return a.marker == b.marker && bytes.Equal(a.data, b.data)
+			}) {
+				t.Errorf("splitJPEG() segments = %q, want %q", segments, tt.segments)
+			}
+			if !bytes.Equal(rest, scan) {
+				t.Errorf("splitJPEG() rest = %q, want %q", rest, scan)
+			}
+		})
+	}
+}
+
+func TestJoinJPEG(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []jpegSegment
+		wantErr  bool
+	}{
+		{"no segments", nil, false},
+		{"segments", []jpegSegment{{jpegAPP0, []byte("JFIF\x00")}, {jpegAPP13, []byte{}}}, false},
+		{"largest segment", []jpegSegment{{jpegAPP1, make([]byte, jpegMaxSegment)}}, false},
+		{"segment too large", []jpegSegment{{jpegAPP1, make([]byte, jpegMaxSegment+1)}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := joinJPEG(tt.segments, scan)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("joinJPEG() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			segments, rest, err := splitJPEG(bs)
+			if err != nil {
+				t.Fatalf("splitJPEG() of joined JPEG error = %v", err)
+			}
+			if len(segments) != len(tt.segments) || !bytes.Equal(rest, scan) {
+				t.Fatalf("joined JPEG split into %d segments and %q", len(segments), rest)
+			}
+			for i := range segments {
+				if segments[i].marker != tt.segments[i].marker || !bytes.Equal(segments[i].data, tt.segments[i].data) {
+					t.Errorf("segment %d = %X %q, want %X %q", i,
+						segments[i].marker, segments[i].data, tt.segments[i].marker, tt.segments[i].data)
+				}
+			}
+		})
+	}
+}
+
+func TestSetResourceKeywords(t *testing.T) {
+	charset := testDataset(1, 90, iptcUTF8)
+	// Odd sized data is padded, and so are names whose length byte and characters add up to an odd size
+	other := testResource(0x040C, "thumb", []byte("odd"))
+	unnamed := testResource(0x0425, "", []byte("even"))
+	tests := []struct {
+		name      string
+		resources []byte
+		want      []byte
+		wantErr   bool
+	}{
+		{"no resources", nil,
+			testResource(iptcResource, "", testDataset(2, 25, "a")), false},
+		{"no IPTC resource", slices.Concat(other, unnamed),
+			slices.Concat(other, unnamed, testResource(iptcResource, "", testDataset(2, 25, "a"))), false},
+		{"IPTC resource", slices.Concat(other, testResource(iptcResource, "", charset), unnamed),
+			slices.Concat(other, testResource(iptcResource, "", slices.Concat(charset, testDataset(2, 25, "a"))), unnamed), false},
+		{"named IPTC resource", testResource(iptcResource, "iptc", testDataset(2, 25, "old")),
+			testResource(iptcResource, "iptc", testDataset(2, 25, "a")), false},
+		{"unpadded last resource", other[:len(other)-1],
+			slices.Concat(other[:len(other)-1], testResource(iptcResource, "", testDataset(2, 25, "a"))), false},
+		{"not a resource", []byte("8BIX\x04\x04\x00\x00\x00\x00\x00\x00"), nil, true},
+		{"truncated header", []byte("8BIM\x04\x04"), nil, true},
+		{"data past the end", []byte("8BIM\x04\x04\x00\x00\x00\x00\x00\x10"), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setResourceKeywords(tt.resources, []string{"a"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setResourceKeywords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("setResourceKeywords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetIIMKeywords(t *testing.T) {
+	charset := testDataset(1, 90, iptcUTF8)
+	caption := testDataset(2, 120, "caption")
+	long := strings.Repeat("é", 40)
+	tests := []struct {
+		name     string
+		iim      []byte
+		keywords []string
+		want     []byte
+		wantErr  bool
+	}{
+		{"empty", nil, []string{"a", "b"},
+			slices.Concat(testDataset(2, 25, "a"), testDataset(2, 25, "b")), false},
+		{"no keywords", slices.Concat(charset, testDataset(2, 25, "old"), caption), nil,
+			slices.Concat(charset, caption), false},
+		{"in order", slices.Concat(charset, testDataset(2, 5, "title"), caption), []string{"a", "b"},
+			slices.Concat(charset, testDataset(2, 5, "title"), testDataset(2, 25, "a"), testDataset(2, 25, "b"), caption), false},
+		{"replaces keywords", slices.Concat(testDataset(2, 25, "old"), testDataset(2, 25, "older"), caption), []string{"new"},
+			slices.Concat(testDataset(2, 25, "new"), caption), false},
+		{"after the last record", slices.Concat(charset, testDataset(2, 5, "title")), []string{"a"},
+			slices.Concat(charset, testDataset(2, 5, "title"), testDataset(2, 25, "a")), false},
+		{"truncated to a whole character", nil, []string{long},
+			testDataset(2, 25, strings.Repeat("é", iptcKeywordSize/2)), false},
+		{"extended dataset", slices.Concat([]byte{0x1C, 2, 202, 0x80, 0x02, 0x00, 0x03}, []byte("bin")), []string{"a"},
+			slices.Concat(testDataset(2, 25, "a"), []byte{0x1C, 2, 202, 0x80, 0x02, 0x00, 0x03}, []byte("bin")), false},
+		{"padding dropped", slices.Concat(charset, []byte{0, 0}), []string{"a"},
+			slices.Concat(charset, testDataset(2, 25, "a")), false},
+		{"truncated dataset", []byte{0x1C, 2, 25, 0x00}, nil, nil, true},
+		{"dataset past the end", []byte{0x1C, 2, 25, 0x00, 0x10, 'a'}, nil, nil, true},
+		{"extended size too long", []byte{0x1C, 2, 202, 0x80, 0x05, 0, 0, 0, 0, 1, 'a'}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := setIIMKeywords(tt.iim, tt.keywords)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setIIMKeywords() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("setIIMKeywords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		size int
+		want string
+	}{
+		{"short", "abc", 5, "abc"},
+		{"exact", "abcde", 5, "abcde"},
+		{"ascii", "abcdef", 5, "abcde"},
+		{"two byte character", "aéé", 4, "aé"},
+		{"inside a character", "aéé", 3, "aé"},
+		{"four byte character", "a😀b", 4, "a"},
+		{"nothing fits", "😀", 3, ""},
+		{"empty", "", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateUTF8(tt.s, tt.size); got != tt.want {
+				t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXmlText(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"fish & chips", "fish &amp; chips"},
+		{"<b>\"hi\"</b>", "&lt;b&gt;&#34;hi&#34;&lt;/b&gt;"},
+		{"it's", "it&#39;s"},
+		{"ünïcode", "ünïcode"},
+		{"line\nbreak", "line&#xA;break"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := xmlText(tt.s); got != tt.want {
+				t.Errorf("xmlText(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbedJPEGMetadata(t *testing.T) {
+	app0 := jpegSegment{jpegAPP0, []byte("JFIF\x00")}
+	exif := jpegSegment{jpegAPP1, []byte("Exif\x00\x00II*\x00")}
+	dqt := jpegSegment{0xDB, []byte{0x00, 0x01}}
+	packet := func(description string) []byte {
+		return []byte(jpegXmpHeader + xmpPacketStart + description + xmpPacketEnd)
+	}
+	photoshop := func(resources ...[]byte) []byte {
+		return append([]byte(jpegPhotoshopHeader), slices.Concat(resources...)...)
+	}
+	description := `<rdf:Description rdf:about=""><dc:source>x</dc:source></rdf:Description>`
+	existing := `<rdf:Description rdf:about="" xmlns:tiff="http://ns.adobe.com/tiff/1.0/"/>`
+	large := strings.Repeat("x", jpegMaxSegment-len(packet(existing))+1)
+	tests := []struct {
+		name        string
+		segments    []jpegSegment
+		keywords    []string
+		description string
+		want        []jpegSegment
+	}{
+		{"no metadata", []jpegSegment{app0, exif, dqt}, []string{"a", "b"}, description,
+			[]jpegSegment{app0, exif,
+				{jpegAPP1, packet(description)},
+				{jpegAPP13, photoshop(testResource(iptcResource, "", slices.Concat(testDataset(2, 25, "a"), testDataset(2, 25, "b"))))},
+				dqt}},
+		{"nothing to add", []jpegSegment{app0, dqt}, nil, "",
+			[]jpegSegment{app0, dqt}},
+		{"existing metadata", []jpegSegment{app0, exif, {jpegAPP1, packet(existing)},
+			{jpegAPP13, photoshop(testResource(0x040C, "t", []byte("odd")), testResource(iptcResource, "", testDataset(2, 25, "old")))}, dqt},
+			[]string{"new"}, description,
+			[]jpegSegment{app0, exif, {jpegAPP1, packet(existing + description)},
+				{jpegAPP13, photoshop(testResource(0x040C, "t", []byte("odd")), testResource(iptcResource, "", testDataset(2, 25, "new")))}, dqt}},
+		{"other APP13", []jpegSegment{app0, {jpegAPP13, []byte("Other\x00")}, dqt}, []string{"a"}, "",
+			[]jpegSegment{app0, {jpegAPP13, photoshop(testResource(iptcResource, "", testDataset(2, 25, "a")))},
+				{jpegAPP13, []byte("Other\x00")}, dqt}},
+		{"XMP too large to add to", []jpegSegment{app0, {jpegAPP1, packet(existing)}, dqt}, nil, large,
+			[]jpegSegment{app0, {jpegAPP1, packet(existing)}, dqt}},
+		{"XMP too large to create", []jpegSegment{app0, dqt}, nil, large + strings.Repeat("x", len(existing)),
+			[]jpegSegment{app0, dqt}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := embedJPEGMetadata(testJPEG(t, tt.segments...), tt.keywords, tt.description)
+			if err != nil {
+				t.Fatalf("embedJPEGMetadata() error = %v", err)
+			}
+			if want := testJPEG(t, tt.want...); !bytes.Equal(got, want) {
+				t.Errorf("embedJPEGMetadata() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	t.Run("keywords read back", func(t *testing.T) {
+		keywords := []string{"one", "twö", strings.Repeat("é", 40)}
+		got, err := embedJPEGMetadata(testJPEG(t, app0), keywords, "")
+		if err != nil {
+			t.Fatalf("embedJPEGMetadata() error = %v", err)
+		}
+		segments, _, err := splitJPEG(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iim := segments[1].data[len(jpegPhotoshopHeader)+12:]
+		want := []string{"one", "twö", strings.Repeat("é", iptcKeywordSize/2)}
+		if got := testKeywords(t, iim); !slices.Equal(got, want) {
+			t.Errorf("keywords = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("not a JPEG", func(t *testing.T) {
+		_, err := embedJPEGMetadata([]byte("\x89PNG\r\n"), []string{"a"}, description)
+		if err == nil {
+			t.Error("embedJPEGMetadata() of a PNG didn't fail")
+		}
+	})
+}
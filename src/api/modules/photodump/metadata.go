@@ -0,0 +1,288 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/responses"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kolesa-team/goexiv"
+)
+
+// ------------------- Types -------------------
+
+// Camera A camera make and model, along with how many photos were taken with it
+type Camera struct {
+	Make   string `json:"make" db:"camera_make"`
+	Model  string `json:"model" db:"camera_model"`
+	Photos int    `json:"photos,omitempty" db:"photos"`
+}
+
+// -------------- Globals --------------
+
+// MaxMetadataValueSize Metadata values longer than this are left out of the stored metadata,
+// they're almost always binary blobs like maker notes and embedded thumbnails
+const MaxMetadataValueSize = 512
+
+// xmpKeys The XMP keys that are copied into the stored metadata, since exiv2 can't list them for us
+var xmpKeys = []string{
+	"Xmp.dc.subject",
+	"Xmp.dc.description",
+	"Xmp.aux.Lens",
+	"Xmp.photoshop.DateCreated",
+	"Xmp.exif.GPSLatitude",
+	"Xmp.exif.GPSLongitude",
+}
+
+// ------------------- Store -------------------
+
+// updatePhotoMetadataQuery The fields edits also change only bump modified_at when they're different
+const updatePhotoMetadataQuery = `
+UPDATE photos SET
+taken_at = $2, taken_at_source = $3, taken_at_offset = $4,
+camera_make = $5, camera_model = $6, lens = $7,
+exposure_time = $8, f_number = $9, iso = $10, focal_length = $11, orientation = $12,
+latitude = $13, longitude = $14, keywords = $15, metadata = $16,
+regions = $17, people = $18,
+modified_at = CASE
+	WHEN (taken_at, taken_at_source, taken_at_offset, regions, people) IS DISTINCT FROM ($2, $3, $4, $17, $18)
+	THEN NOW() ELSE modified_at END
+WHERE id = $1 AND modified_at = $19 AND deleted_at IS NULL`
+
+// UpdatePhotoMetadata Update only the fields extracted from the Exiv2 metadata of a Photo in the database,
+// as long as it hasn't been modified since modifiedAt or moved to the trash. Returns whether it was updated.
+func (s *store) UpdatePhotoMetadata(p *Photo, modifiedAt time.Time) (bool, error) {
+	p.EnsureNonNil()
+	tag, err := s.db.Exec(context.Background(), updatePhotoMetadataQuery,
+		p.ID, p.TakenAt, p.TakenAtSource, p.TakenAtOffset,
+		p.CameraMake, p.CameraModel, p.Lens,
+		p.ExposureTime, p.FNumber, p.ISO, p.FocalLength, p.Orientation,
+		p.Latitude, p.Longitude, p.Keywords, p.Metadata,
+		p.Regions, p.People, modifiedAt)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+const getCamerasQuery = `
+SELECT camera_make, camera_model, COUNT(*) AS photos FROM photos
+WHERE deleted_at IS NULL AND (camera_make <> '' OR camera_model <> '')
+GROUP BY camera_make, camera_model
+ORDER BY photos DESC, camera_make, camera_model`
+
+// GetCameras Get every camera that photos have been taken with
+func (s *store) GetCameras() ([]*Camera, error) {
+	rows, err := s.db.Query(context.Background(), getCamerasQuery)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Camera])
+}
+
+// ------------------- Service -------------------
+
+// GetCameras Get every camera that photos have been taken with
+func (s *service) GetCameras() ([]*Camera, int, error) {
+	cameras, err := s.ps.GetCameras()
+	if err != nil {
+		log.Println("could not get cameras", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get cameras")
+	}
+	return cameras, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// GetExivData Get Exiv2 data from a file and and add it to the photo
+func (p *Photo) GetExivData(bs []byte) error {
+	img, err := goexiv.OpenBytes(bs)
+	if err != nil {
+		log.Println("could not retrieve photo metadata. ID: "+p.ID, err)
+		return nil
+	}
+	err = img.ReadMetadata()
+	if err != nil {
+		log.Println("could not retrieve photo metadata. ID: "+p.ID, err)
+		return nil
+	}
+
+	exif := img.GetExifData().AllTags()
+	iptc := iptcTags(img.GetIptcData())
+	xmp := xmpTags(img.GetXmpData())
+
+	p.setTakenAtFromTags(exif, iptc)
+
+	p.CameraMake = cleanTag(exif["Exif.Image.Make"])
+	p.CameraModel = cleanTag(exif["Exif.Image.Model"])
+	p.Lens = cleanTag(exif["Exif.Photo.LensModel"])
+	if p.Lens == "" {
+		p.Lens = cleanTag(xmp["Xmp.aux.Lens"])
+	}
+	p.ExposureTime = formatExposure(exif["Exif.Photo.ExposureTime"])
+	p.FNumber = parseRationalPtr(exif["Exif.Photo.FNumber"])
+	p.FocalLength = parseRationalPtr(exif["Exif.Photo.FocalLength"])
+	p.ISO = nil
+	if iso, err := strconv.Atoi(firstField(exif["Exif.Photo.ISOSpeedRatings"])); err == nil && iso > 0 {
+		p.ISO = &iso
+	}
+	p.Orientation = Normal
+	if o, err := strconv.Atoi(firstField(exif["Exif.Image.Orientation"])); err == nil && o >= int(Normal) && o <= int(Rotate270) {
+		p.Orientation = Orientation(o)
+	}
+	// Regions drawn by hand are kept, the ones from the file are read again
+	regions := slices.DeleteFunc(slices.Clone(p.Regions), func(r Region) bool { return r.Source != ManualRegion })
+	p.Regions = append(regions, xmpRegions(img.GetXmpData(), p.Orientation)...)
+	p.Latitude = parseGPSCoordinate(exif["Exif.GPSInfo.GPSLatitude"], exif["Exif.GPSInfo.GPSLatitudeRef"], 90)
+	p.Longitude = parseGPSCoordinate(exif["Exif.GPSInfo.GPSLongitude"], exif["Exif.GPSInfo.GPSLongitudeRef"], 180)
+	if p.Latitude == nil || p.Longitude == nil {
+		p.Latitude, p.Longitude = nil, nil
+	}
+
+	p.Keywords = make([]string, 0)
+	keywords := strings.Split(iptc["Iptc.Application2.Keywords"], "\n")
+	keywords = append(keywords, strings.Split(xmp["Xmp.dc.subject"], ", ")...)
+	for _, keyword := range keywords {
+		keyword = strings.TrimSpace(keyword)
+		if keyword != "" && !slices.Contains(p.Keywords, keyword) {
+			p.Keywords = append(p.Keywords, keyword)
+		}
+	}
+
+	p.Metadata = make(map[string]string)
+	for _, tags := range []map[string]string{exif, iptc, xmp} {
+		for key, value := range tags {
+			if len(value) > MaxMetadataValueSize || strings.Contains(key, "MakerNote") {
+				continue
+			}
+			p.Metadata[key] = value
+		}
+	}
+	log.Println("photo metadata aquired. ID: " + p.ID)
+	return nil
+}
+
+// iptcTags Get all the IPTC tags, joining repeated tags like keywords with newlines
+func iptcTags(data *goexiv.IptcData) map[string]string {
+	tags := make(map[string]string)
+	for i := data.Iterator(); i.HasNext(); {
+		datum := i.Next()
+		if value, ok := tags[datum.Key()]; ok {
+			tags[datum.Key()] = value + "\n" + datum.String()
+			continue
+		}
+		tags[datum.Key()] = datum.String()
+	}
+	return tags
+}
+
+// xmpTags Get the XMP tags we know about, exiv2 doesn't let us iterate over them
+func xmpTags(data *goexiv.XmpData) map[string]string {
+	tags := make(map[string]string)
+	for _, key := range xmpKeys {
+		datum, err := data.FindKey(key)
+		if err != nil || datum == nil {
+			continue
+		}
+		tags[key] = datum.String()
+	}
+	return tags
+}
+
+// cleanTag Strip the padding cameras like to leave in their ASCII tags
+func cleanTag(value string) string {
+	return strings.TrimSpace(strings.Trim(value, "\x00"))
+}
+
+// firstField The first of the space separated values in a tag
+func firstField(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// parseRational Parse an EXIF rational like "28/10"
+func parseRational(value string) (float64, bool) {
+	num, den, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		f, err := strconv.ParseFloat(num, 64)
+		return f, err == nil
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0, false
+	}
+	return n / d, true
+}
+
+// parseRationalPtr Parse an EXIF rational, returning nil if it's missing or invalid
+func parseRationalPtr(value string) *float64 {
+	f, ok := parseRational(value)
+	if !ok || f <= 0 {
+		return nil
+	}
+	return &f
+}
+
+// formatExposure Format an exposure time the way photographers write it, like "1/250" or "2.5"
+func formatExposure(value string) string {
+	f, ok := parseRational(value)
+	if !ok || f <= 0 {
+		return ""
+	}
+	if f < 1 {
+		return "1/" + strconv.FormatFloat(math.Round(1/f), 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseGPSCoordinate Parse an EXIF GPS coordinate like "51/1 30/1 1234/100" into decimal degrees
+func parseGPSCoordinate(value string, ref string, limit float64) *float64 {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil
+	}
+	var degrees float64
+	for i, field := range fields {
+		f, ok := parseRational(field)
+		if !ok {
+			return nil
+		}
+		degrees += f / math.Pow(60, float64(i))
+	}
+	switch strings.ToUpper(cleanTag(ref)) {
+	case "S", "W":
+		degrees = -degrees
+	}
+	if math.Abs(degrees) > limit {
+		return nil
+	}
+	return &degrees
+}
+
+// ------------------- Handlers -------------------
+
+// GetCameras Get every camera that photos have been taken with
+func GetCameras(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cameras, status, err := s.GetCameras()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, cameras)
+	}
+}
@@ -0,0 +1,129 @@
+package photodump
+
+import (
+	"encoding/binary"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/corona10/goimagehash"
+	"github.com/kolesa-team/goexiv"
+	"github.com/nfnt/resize"
+)
+
+// ------------------- Types -------------------
+
+// Orientation The EXIF orientation of an image, see https://exiftool.org/TagNames/EXIF.html
+type Orientation int
+
+const (
+	Normal Orientation = iota + 1
+	FlipHorizontal
+	Rotate180
+	FlipVertical
+	Transpose
+	Rotate90
+	Transverse
+	Rotate270
+)
+
+// Orientations Every orientation an image can be rotated or mirrored into
+var Orientations = []Orientation{
+	Normal, FlipHorizontal, Rotate180, FlipVertical,
+	Transpose, Rotate90, Transverse, Rotate270,
+}
+
+// Swapped Whether the orientation swaps the width and height of the image
+func (o Orientation) Swapped() bool {
+	return o >= Transpose && o <= Rotate270
+}
+
+// source Maps a pixel in the oriented image back to the original image of size w x h
+func (o Orientation) source(x, y, w, h int) (int, int) {
+	switch o {
+	case FlipHorizontal:
+		return w - 1 - x, y
+	case Rotate180:
+		return w - 1 - x, h - 1 - y
+	case FlipVertical:
+		return x, h - 1 - y
+	case Transpose:
+		return y, x
+	case Rotate90:
+		return y, h - 1 - x
+	case Transverse:
+		return w - 1 - y, h - 1 - x
+	case Rotate270:
+		return w - 1 - y, x
+	default:
+		return x, y
+	}
+}
+
+// ------------------- Functions -------------------
+
+// Orient Apply an EXIF orientation to an image so that it displays upright
+func Orient(img image.Image, o Orientation) image.Image {
+	if o <= Normal || o > Rotate270 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o.Swapped() {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := o.source(x, y, w, h)
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// ExifOrientation Read the EXIF orientation tag from an image, defaulting to Normal
+func ExifOrientation(bs []byte) Orientation {
+	img, err := goexiv.OpenBytes(bs)
+	if err != nil {
+		return Normal
+	}
+	err = img.ReadMetadata()
+	if err != nil {
+		return Normal
+	}
+	str, err := img.GetExifData().GetString("Exif.Image.Orientation")
+	if err != nil || str == "" {
+		return Normal
+	}
+	o, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil || o < int(Normal) || o > int(Rotate270) {
+		log.Println("invalid orientation tag: " + str)
+		return Normal
+	}
+	return Orientation(o)
+}
+
+// PHashBytes Convert a perceptual hash to the byte representation stored in the database
+func PHashBytes(ph *goimagehash.ImageHash) []byte {
+	phash := make([]byte, 8)
+	binary.LittleEndian.PutUint64(phash, ph.GetHash())
+	return phash
+}
+
+// OrientedPHashes Get the perceptual hashes of an image in all eight orientations
+func OrientedPHashes(img image.Image) ([][]byte, error) {
+	// The phash is computed from a 64x64 thumbnail, so rotate that instead of the whole image
+	small := resize.Resize(64, 64, img, resize.Bilinear)
+	phashes := make([][]byte, 0, len(Orientations))
+	for _, o := range Orientations {
+		ph, err := goimagehash.PerceptionHash(Orient(small, o))
+		if err != nil {
+			return nil, err
+		}
+		phashes = append(phashes, PHashBytes(ph))
+	}
+	return phashes, nil
+}
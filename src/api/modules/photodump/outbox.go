@@ -0,0 +1,206 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// ObjectDeletion An object in the photos bucket that's waiting in the outbox to be deleted.
+// Objects are queued in the same statement that stops a row referring to them,
+// and uploads queue theirs before writing it, cancelling it once the row is saved,
+// so a crash at any point leaves the outbox to tidy up rather than an orphan.
+// While a deletion is claimed RunAt is when its lease runs out, and the object can't be queued again until then,
+// so a photo can't be moved back into an object that's about to be deleted.
+type ObjectDeletion struct {
+	Object    string    `json:"object" db:"object"`
+	PhotoID   string    `json:"photo_id" db:"photo_id"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	Claimed   bool      `json:"claimed" db:"claimed"`
+	LastError string    `json:"last_error,omitempty" db:"last_error"`
+	RunAt     time.Time `json:"run_at" db:"run_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// -------------- Globals --------------
+
+// OutboxUploadGrace How long an object being written can go without a row referring to it before it's deleted
+const OutboxUploadGrace = 24 * time.Hour
+
+// OutboxLease How long a claimed deletion is hidden from other workers while it runs
+const OutboxLease = 5 * time.Minute
+
+// OutboxPollInterval How often the outbox is checked for deletions that are due
+const OutboxPollInterval = time.Minute
+
+// OutboxBatch The most deletions claimed from the outbox in one go
+const OutboxBatch = 100
+
+// errDeletionClaimed An object couldn't be queued because its deletion is already underway
+var errDeletionClaimed = errors.New("object is being deleted")
+
+// ------------------- Store -------------------
+
+// queueDeletionsSQL Add objects to the outbox, pushing back the ones that are already in it unless they're claimed
+const queueDeletionsSQL = `
+INSERT INTO photo_outbox (object, photo_id, attempts, claimed, last_error, run_at, created_at)
+SELECT object, $1, 0, FALSE, '', $3, NOW() FROM UNNEST($2::TEXT[]) AS object
+ON CONFLICT (object) DO UPDATE SET
+photo_id = EXCLUDED.photo_id, attempts = 0, claimed = FALSE, last_error = '', run_at = EXCLUDED.run_at
+WHERE NOT photo_outbox.claimed OR photo_outbox.run_at <= NOW()`
+
+// QueueObjectDeletions Add objects to the outbox, to be deleted once runAt has passed.
+// Returns errDeletionClaimed if any of them are being deleted right now, the rest are still queued.
+func (s *store) QueueObjectDeletions(photoID string, objects []string, runAt time.Time) error {
+	tag, err := s.db.Exec(context.Background(), queueDeletionsSQL, photoID, objects, runAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() < int64(len(objects)) {
+		return errDeletionClaimed
+	}
+	return nil
+}
+
+const claimDeletionsQuery = `
+UPDATE photo_outbox SET attempts = attempts + 1, claimed = TRUE, run_at = NOW() + $2 * INTERVAL '1 second'
+WHERE object IN (
+	SELECT object FROM photo_outbox
+	WHERE run_at <= NOW()
+	ORDER BY run_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED)
+RETURNING *`
+
+// ClaimObjectDeletions Take up to limit deletions that are due off the outbox, leasing them while they run
+func (s *store) ClaimObjectDeletions(limit int) ([]*ObjectDeletion, error) {
+	rows, err := s.db.Query(context.Background(), claimDeletionsQuery, limit, OutboxLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[ObjectDeletion])
+}
+
+// CompleteObjectDeletion Remove a deletion from the outbox, unless it's been queued again since it was claimed
+func (s *store) CompleteObjectDeletion(d *ObjectDeletion) error {
+	_, err := s.db.Exec(context.Background(),
+		"DELETE FROM photo_outbox WHERE object = $1 AND run_at = $2", d.Object, d.RunAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateObjectDeletion Update when a deletion will be retried, and why it failed
+func (s *store) UpdateObjectDeletion(d *ObjectDeletion) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE photo_outbox SET claimed = FALSE, last_error = $2, run_at = $3 WHERE object = $1",
+		d.Object, d.LastError, d.RunAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetOutboxObjects Get every object in the outbox, whether it's due or not
+func (s *store) GetOutboxObjects() ([]string, error) {
+	rows, err := s.db.Query(context.Background(), "SELECT object FROM photo_outbox")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// ------------------- Service -------------------
+
+// wakeOutbox Wake the outbox worker, unless it's already being woken
+func (s *service) wakeOutbox() {
+	select {
+	case s.outbox <- struct{}{}:
+	default:
+	}
+}
+
+// runOutbox Delete a batch of the objects that are due, returning whether there might be more
+func (s *service) runOutbox() bool {
+	deletions, err := s.ps.ClaimObjectDeletions(OutboxBatch)
+	if err != nil {
+		log.Println("could not claim object deletions", err)
+		return false
+	}
+	for _, d := range deletions {
+		err = s.ps.DeleteObjectFromS3(d.Object)
+		if err != nil {
+			d.LastError = err.Error()
+			d.RunAt = time.Now().Add(jobBackoff(d.Attempts))
+			log.Println("object deletion will be retried. ID: "+d.PhotoID+" Object: "+d.Object, err)
+			err = s.ps.UpdateObjectDeletion(d)
+			if err != nil {
+				log.Println("could not update object deletion. ID: "+d.PhotoID+" Object: "+d.Object, err)
+			}
+			continue
+		}
+		err = s.ps.CompleteObjectDeletion(d)
+		if err != nil {
+			log.Println("could not complete object deletion. ID: "+d.PhotoID+" Object: "+d.Object, err)
+			continue
+		}
+		log.Println("deleted object. ID: " + d.PhotoID + " Object: " + d.Object)
+	}
+	if len(deletions) > 0 {
+		log.Println("processed " + strconv.Itoa(len(deletions)) + " object deletions")
+	}
+	return len(deletions) == OutboxBatch
+}
+
+// outboxWorker Delete the objects in the outbox as they come due, until the context is cancelled
+func (s *service) outboxWorker(ctx context.Context) {
+	ticker := time.NewTicker(OutboxPollInterval)
+	defer ticker.Stop()
+	for {
+		for s.runOutbox() {
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.outbox:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ------------------- Functions -------------------
+
+// photoObjects The names of every object in the photos bucket that a photo refers to, starting with the original
+func photoObjects(photo *Photo) []string {
+	original := photoObject(photo)
+	if photo.DeletedAt != nil {
+		original = TrashPrefix + original
+	}
+	objects := []string{original}
+	for _, d := range photo.Derivatives {
+		objects = append(objects, derivativeObject(photo, d.Width))
+	}
+	if photo.Rendition != "" {
+		objects = append(objects, path.Base(photo.Rendition))
+	}
+	return objects
+}
+
+// withoutObjects The objects that aren't in keep
+func withoutObjects(objects []string, keep []string) []string {
+	return slices.DeleteFunc(slices.Clone(objects), func(object string) bool {
+		return slices.Contains(keep, object)
+	})
+}
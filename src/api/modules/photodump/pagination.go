@@ -0,0 +1,158 @@
+package photodump
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------- Types -------------------
+
+// Cursor A position in a sorted list of photos, the sort key followed by the ID.
+// Photos are sorted by Time, unless they're sorted by relevance to a search.
+type Cursor struct {
+	Sort PhotoSort
+	Time time.Time
+	Rank float32
+	ID   string
+	// Backward Whether the page before the cursor is wanted, rather than the page after it
+	Backward bool
+}
+
+// PhotoPage A page of photos, along with the cursors and links for the pages either side of it
+type PhotoPage struct {
+	Photos     []*FoundPhoto `json:"photos"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	PrevCursor string        `json:"prev_cursor,omitempty"`
+	Next       string        `json:"next,omitempty"`
+	Prev       string        `json:"prev,omitempty"`
+}
+
+// -------------- Globals --------------
+
+// DefaultPageAmount How many photos are on a page by default
+const DefaultPageAmount = 12
+
+// MaxPageAmount The most photos that can be on a page
+const MaxPageAmount = 100
+
+// ------------------- Functions -------------------
+
+// CursorAfter The cursor for the page after a photo
+func CursorAfter(p *FoundPhoto, sort PhotoSort) *Cursor {
+	return &Cursor{Sort: sort, Time: sort.Key(&p.Photo), Rank: p.Rank, ID: p.ID}
+}
+
+// CursorBefore The cursor for the page before a photo
+func CursorBefore(p *FoundPhoto, sort PhotoSort) *Cursor {
+	return &Cursor{Sort: sort, Time: sort.Key(&p.Photo), Rank: p.Rank, ID: p.ID, Backward: true}
+}
+
+// String The cursor encoded as an opaque string
+func (c *Cursor) String() string {
+	direction := "n"
+	if c.Backward {
+		direction = "p"
+	}
+	key := strconv.FormatInt(c.Time.UnixMicro(), 10)
+	if c.Sort == SortRelevance {
+		key = strconv.FormatFloat(float64(c.Rank), 'g', -1, 32)
+	}
+	raw := direction + "|" + string(c.Sort) + "|" + key + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor Decode a cursor for a list in the given order, an empty string is the first page
+func ParseCursor(str string, sort PhotoSort) (*Cursor, error) {
+	if str == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 4)
+	if len(parts) != 4 || (parts[0] != "n" && parts[0] != "p") || parts[3] == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	if PhotoSort(parts[1]) != sort {
+		return nil, errors.New("cursor is for a different sort order")
+	}
+	cursor := &Cursor{Sort: sort, ID: parts[3], Backward: parts[0] == "p"}
+	if sort == SortRelevance {
+		rank, err := strconv.ParseFloat(parts[2], 32)
+		if err != nil || math.IsNaN(rank) || math.IsInf(rank, 0) {
+			return nil, errors.New("invalid cursor")
+		}
+		cursor.Rank = float32(rank)
+		return cursor, nil
+	}
+	micros, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	cursor.Time = time.UnixMicro(micros).UTC()
+	return cursor, nil
+}
+
+// NewPhotoPage Build a page from photos fetched with one more than the amount,
+// so it can tell whether there's anything past it
+func NewPhotoPage(photos []*FoundPhoto, amount int, sort PhotoSort, cursor *Cursor) *PhotoPage {
+	more := len(photos) > amount
+	if more {
+		photos = photos[:amount]
+	}
+	if cursor != nil && cursor.Backward {
+		// Backward pages are fetched in the opposite order
+		slices.Reverse(photos)
+	}
+	page := &PhotoPage{Photos: photos}
+	if len(photos) == 0 {
+		return page
+	}
+
+	hasNext, hasPrev := more, cursor != nil
+	if cursor != nil && cursor.Backward {
+		hasNext, hasPrev = true, more
+	}
+	if hasNext {
+		page.NextCursor = CursorAfter(photos[len(photos)-1], sort).String()
+	}
+	if hasPrev {
+		page.PrevCursor = CursorBefore(photos[0], sort).String()
+	}
+	return page
+}
+
+// SetLinks Fill in the next and prev links from the cursors, keeping the rest of the request's query
+func (page *PhotoPage) SetLinks(r *http.Request) {
+	link := func(cursor string) string {
+		if cursor == "" {
+			return ""
+		}
+		query := r.URL.Query()
+		query.Set("cursor", cursor)
+		return r.URL.Path + "?" + query.Encode()
+	}
+	page.Next = link(page.NextCursor)
+	page.Prev = link(page.PrevCursor)
+}
+
+// SetLinkHeader Add the next and prev links as an RFC 8288 Link header
+func (page *PhotoPage) SetLinkHeader(w http.ResponseWriter) {
+	var links []string
+	if page.Next != "" {
+		links = append(links, "<"+page.Next+`>; rel="next"`)
+	}
+	if page.Prev != "" {
+		links = append(links, "<"+page.Prev+`>; rel="prev"`)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
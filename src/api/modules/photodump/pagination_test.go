@@ -0,0 +1,88 @@
+package photodump
+
+import (
+	"encoding/base64"
+	"math"
+	"testing"
+	"time"
+)
+
+// testCursor Encode a raw cursor the way Cursor.String does, so malformed ones can be made
+func testCursor(raw string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	taken := time.Date(2023, 7, 14, 18, 30, 5, 123456000, time.UTC)
+	tests := []struct {
+		name   string
+		cursor Cursor
+	}{
+		{"taken after", Cursor{Sort: SortTakenDesc, Time: taken, ID: "123"}},
+		{"taken before", Cursor{Sort: SortTakenDesc, Time: taken, ID: "123", Backward: true}},
+		{"taken ascending", Cursor{Sort: SortTakenAsc, Time: taken, ID: "123"}},
+		{"uploaded", Cursor{Sort: SortUploadedDesc, Time: taken, ID: "123"}},
+		{"uploaded ascending", Cursor{Sort: SortUploadedAsc, Time: taken, ID: "123", Backward: true}},
+		{"before 1970", Cursor{Sort: SortTakenDesc, Time: time.Date(1923, 1, 2, 3, 4, 5, 6000, time.UTC), ID: "1"}},
+		{"never taken", Cursor{Sort: SortTakenDesc, Time: time.Time{}, ID: "1"}},
+		{"ID with separators", Cursor{Sort: SortTakenDesc, Time: taken, ID: "a|b|c"}},
+		{"no rank", Cursor{Sort: SortRelevance, Rank: 0, ID: "1"}},
+		{"rank", Cursor{Sort: SortRelevance, Rank: 0.0607927, ID: "1"}},
+		{"rank before", Cursor{Sort: SortRelevance, Rank: 0.1, ID: "1", Backward: true}},
+		{"tiny rank", Cursor{Sort: SortRelevance, Rank: 1e-8, ID: "1"}},
+		{"smallest rank", Cursor{Sort: SortRelevance, Rank: math.SmallestNonzeroFloat32, ID: "1"}},
+		{"largest rank", Cursor{Sort: SortRelevance, Rank: math.MaxFloat32, ID: "1"}},
+		{"rank that isn't a short decimal", Cursor{Sort: SortRelevance, Rank: float32(1) / 3, ID: "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCursor(tt.cursor.String(), tt.cursor.Sort)
+			if err != nil {
+				t.Fatalf("ParseCursor() error = %v", err)
+			}
+			if got.Sort != tt.cursor.Sort || !got.Time.Equal(tt.cursor.Time) || got.Rank != tt.cursor.Rank ||
+				got.ID != tt.cursor.ID || got.Backward != tt.cursor.Backward {
+				t.Errorf("ParseCursor() = %+v, want %+v", *got, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		sort    PhotoSort
+		wantNil bool
+		wantErr bool
+	}{
+		{"first page", "", SortTakenDesc, true, false},
+		{"valid", testCursor("n|taken_at_desc|1689359405123456|123"), SortTakenDesc, false, false},
+		{"not base64", "not a cursor!", SortTakenDesc, true, true},
+		{"padded base64", testCursor("n|taken_at_desc|1|123") + "=", SortTakenDesc, true, true},
+		{"standard base64", "bnx0YWtlbl9hdF9kZXNjfDF8/w", SortTakenDesc, true, true},
+		{"unknown direction", testCursor("x|taken_at_desc|1|123"), SortTakenDesc, true, true},
+		{"too few parts", testCursor("n|taken_at_desc|1"), SortTakenDesc, true, true},
+		{"no ID", testCursor("n|taken_at_desc|1|"), SortTakenDesc, true, true},
+		{"different sort", testCursor("n|taken_at_asc|1|123"), SortTakenDesc, true, true},
+		{"time cursor for relevance", testCursor("n|taken_at_desc|1|123"), SortRelevance, true, true},
+		{"time that isn't a number", testCursor("n|taken_at_desc|yesterday|123"), SortTakenDesc, true, true},
+		{"fractional time", testCursor("n|taken_at_desc|1.5|123"), SortTakenDesc, true, true},
+		{"time out of range", testCursor("n|taken_at_desc|99999999999999999999|123"), SortTakenDesc, true, true},
+		{"rank that isn't a number", testCursor("n|relevance|best|123"), SortRelevance, true, true},
+		{"rank out of range", testCursor("n|relevance|1e39|123"), SortRelevance, true, true},
+		{"infinite rank", testCursor("n|relevance|Inf|123"), SortRelevance, true, true},
+		{"NaN rank", testCursor("n|relevance|NaN|123"), SortRelevance, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCursor(tt.str, tt.sort)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCursor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("ParseCursor() = %+v, want nil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package photodump
+
+import (
+	"errors"
+	"home_api/src/responses"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ------------------- Types -------------------
+
+// PhotoPatch The fields of a photo that can be edited, nil fields are left as they are
+type PhotoPatch struct {
+	Description *string
+	Source      *string
+	Subjects    *[]string
+	Tags        *[]string
+	TakenAt     *time.Time
+	// Regions Only set by SetPhotoRegions and reverts, they're validated before they're patched in
+	Regions *[]Region
+	// Revert Whether the patch puts back values from the history, rather than being an edit.
+	// Tags that have since been renamed or merged follow their new name, and deleted ones are dropped.
+	// TakenAtSource and TakenAtOffset are set along with TakenAt, so the time is put back exactly as it was.
+	Revert        bool
+	TakenAtSource TimeSource
+	TakenAtOffset *int
+}
+
+// -------------- Globals --------------
+
+// patchableFields The fields a JSON Merge Patch can change, everything else is controlled by the server
+var patchableFields = []string{"description", "source", "subjects", "tags", "taken_at"}
+
+// ------------------- Service -------------------
+
+// PatchPhoto Apply a patch to a photo, as long as the ETag still matches so no one else's edit is lost
+func (s *service) PatchPhoto(id string, patch *PhotoPatch, ifMatch string, actor string) (*Photo, int, error) {
+	photo, status, err := s.GetPhotoById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	if !photo.MatchesETag(ifMatch) {
+		return nil, http.StatusPreconditionFailed, errors.New("photo has been modified, get it again for the current ETag")
+	}
+	status, err = s.savePatch(photo, patch, actor, HistoryEdit)
+	if err != nil {
+		return nil, status, err
+	}
+	return photo, http.StatusOK, nil
+}
+
+// savePatch Apply a patch to a photo and save it, unless it's been modified since it was read.
+// The fields that changed are recorded in the history of the photo, and nothing is saved if none did.
+func (s *service) savePatch(photo *Photo, patch *PhotoPatch, actor string, action HistoryAction) (int, error) {
+	before := editableFields(photo)
+	if patch.Description != nil {
+		photo.Description = *patch.Description
+	}
+	if patch.Source != nil {
+		photo.Source = *patch.Source
+	}
+	if patch.Subjects != nil {
+		photo.Subjects = slices.Clone(*patch.Subjects)
+	}
+	if patch.Regions != nil {
+		photo.Regions = slices.Clone(*patch.Regions)
+	}
+	if patch.Subjects != nil || patch.Regions != nil {
+		status, err := linkPeople(photo, s.GetPeople())
+		if err != nil {
+			return status, err
+		}
+	}
+	if patch.Tags != nil && patch.Revert {
+		photoTags, deleted, status, err := s.ts.ResolveTags(*patch.Tags)
+		if err != nil {
+			return status, err
+		}
+		photo.Tags = slices.DeleteFunc(photoTags, func(tag string) bool { return slices.Contains(deleted, tag) })
+	} else if patch.Tags != nil {
+		photoTags, status, err := s.ts.NormalizeTags(*patch.Tags)
+		if err != nil {
+			return status, err
+		}
+		photo.Tags = photoTags
+	}
+	if patch.TakenAt != nil && patch.Revert {
+		photo.TakenAt = *patch.TakenAt
+		photo.TakenAtSource = patch.TakenAtSource
+		photo.TakenAtOffset = patch.TakenAtOffset
+	} else if patch.TakenAt != nil {
+		photo.SetTakenAt(*patch.TakenAt, ManualTime)
+	}
+	changes := diffFields(before, editableFields(photo))
+	if len(changes) == 0 {
+		return http.StatusOK, nil
+	}
+
+	modifiedAt := photo.ModifiedAt
+	// The database only keeps microseconds, and the ETag has to match what's read back
+	photo.ModifiedAt = time.Now().Truncate(time.Microsecond)
+	updated, err := s.ps.UpdatePhoto(photo, modifiedAt)
+	if err != nil {
+		log.Println("could not update photo. ID: "+photo.ID, err)
+		return http.StatusInternalServerError, errors.New("could not update photo")
+	}
+	if !updated {
+		return http.StatusPreconditionFailed, errors.New("photo has been modified or moved to the trash, get it again for the current ETag")
+	}
+	s.recordHistory(photo.ID, action, actor, changes)
+	log.Println("edited photo. ID: " + photo.ID)
+	return http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// ETag The entity tag of the photo, which changes whenever it's edited
+func (p *Photo) ETag() string {
+	return `"` + strconv.FormatInt(p.ModifiedAt.UnixMicro(), 10) + `"`
+}
+
+// MatchesETag Whether an If-Match header matches the photo, using the strong comparison it calls for
+func (p *Photo) MatchesETag(ifMatch string) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == p.ETag() {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePhotoPatch Read a JSON Merge Patch for a photo, rejecting fields that can't be changed.
+// A null removes the description, source, subjects or tags, but the time it was taken can only be replaced.
+func ParsePhotoPatch(bs []byte) (*PhotoPatch, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(bs, &fields)
+	if err != nil {
+		return nil, errors.New("patch must be a JSON object")
+	}
+	patch := &PhotoPatch{}
+	for field, value := range fields {
+		if !slices.Contains(patchableFields, field) {
+			return nil, errors.New(field + " can't be changed, only " + strings.Join(patchableFields, ", ") + " can")
+		}
+		null := string(value) == "null"
+		switch field {
+		case "description":
+			patch.Description = new(string)
+			if !null {
+				err = json.Unmarshal(value, patch.Description)
+			}
+		case "source":
+			patch.Source = new(string)
+			if !null {
+				err = json.Unmarshal(value, patch.Source)
+			}
+		case "subjects":
+			patch.Subjects = &[]string{}
+			if !null {
+				err = json.Unmarshal(value, patch.Subjects)
+			}
+		case "tags":
+			patch.Tags = &[]string{}
+			if !null {
+				err = json.Unmarshal(value, patch.Tags)
+			}
+		case "taken_at":
+			if null {
+				return nil, errors.New("taken_at can't be removed")
+			}
+			patch.TakenAt = new(time.Time)
+			err = json.Unmarshal(value, patch.TakenAt)
+		}
+		if err != nil {
+			return nil, errors.New("invalid " + field)
+		}
+	}
+	return patch, nil
+}
+
+// ------------------- Handlers -------------------
+
+// PatchPhoto Apply a JSON Merge Patch to the photo in the path, the If-Match header must hold its current ETag
+func PatchPhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			responses.SwitchCase(w, r, http.StatusPreconditionRequired, "If-Match header is required, use the ETag from getting the photo")
+			return
+		}
+		bs, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxFieldSize))
+		if err != nil {
+			log.Println("Could not read patch", err)
+			responses.BadRequest(w, r, "Could not read patch")
+			return
+		}
+		patch, err := ParsePhotoPatch(bs)
+		if err != nil {
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		photo, status, err := s.PatchPhoto(r.PathValue("id"), patch, ifMatch, requestActor(r))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		w.Header().Set("ETag", photo.ETag())
+		responses.StructOK(w, r, photo)
+	}
+}
@@ -0,0 +1,157 @@
+package photodump
+
+import (
+	"errors"
+	"home_api/src/api/modules/familytree"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Service -------------------
+
+// GetPeople Get everyone in the family tree, to link photos to.
+// The family tree is only needed for the links, so if it can't be read the error is logged
+// and nil is returned, which leaves the links of a photo as they are.
+func (s *service) GetPeople() []*familytree.Person {
+	people, err := s.fs.GetPeople()
+	if err != nil {
+		log.Println("could not get people, photos won't be linked to them", err)
+		return nil
+	}
+	return people
+}
+
+// namePeople Add the people given by ID with a new photo to its subjects, by name,
+// so they're linked like everyone else and stay linked when the photo is edited
+func namePeople(photo *Photo, people []*familytree.Person) (int, error) {
+	if len(photo.People) == 0 {
+		return http.StatusOK, nil
+	}
+	if people == nil {
+		log.Println("could not check people, not linking them. ID: " + photo.ID)
+		photo.People = nil
+		return http.StatusOK, nil
+	}
+	var named []int64
+	for _, id := range familytree.MatchPeople(people, photo.Subjects) {
+		named = append(named, id)
+	}
+	for _, id := range photo.People {
+		i := slices.IndexFunc(people, func(person *familytree.Person) bool { return person.ID == id })
+		if i == -1 {
+			return http.StatusBadRequest, errors.New("person does not exist: " + strconv.FormatInt(id, 10))
+		}
+		if !slices.Contains(named, id) {
+			photo.Subjects = append(photo.Subjects, people[i].FullName())
+			named = append(named, id)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// linkPeople Work out who is in the photo from the people its subjects and regions name.
+// People is worked out from scratch every time, so fixing a subject or removing a region drops a wrong link,
+// and the subjects keep every name so they can all be searched.
+// Regions that name someone get their ID, and are labelled with their name if they don't have one.
+// people is nil when the family tree couldn't be read, the photo keeps the links it has then.
+func linkPeople(photo *Photo, people []*familytree.Person) (int, error) {
+	subjects := make([]string, 0, len(photo.Subjects))
+	for _, subject := range photo.Subjects {
+		subject = strings.TrimSpace(subject)
+		if subject != "" && !slices.Contains(subjects, subject) {
+			subjects = append(subjects, subject)
+		}
+	}
+	photo.Subjects = subjects
+	if people == nil {
+		return http.StatusOK, nil
+	}
+
+	names := slices.Clone(subjects)
+	for _, region := range photo.Regions {
+		names = append(names, region.Name)
+	}
+	matches := familytree.MatchPeople(people, names)
+	linked := make([]int64, 0)
+	for _, subject := range subjects {
+		if id, ok := matches[subject]; ok && !slices.Contains(linked, id) {
+			linked = append(linked, id)
+		}
+	}
+	for i := range photo.Regions {
+		region := &photo.Regions[i]
+		if region.PersonID == nil {
+			if id, ok := matches[region.Name]; ok {
+				region.PersonID = &id
+			}
+		}
+		if region.PersonID == nil {
+			continue
+		}
+		j := slices.IndexFunc(people, func(person *familytree.Person) bool { return person.ID == *region.PersonID })
+		if j == -1 {
+			return http.StatusBadRequest, errors.New("person does not exist: " + strconv.FormatInt(*region.PersonID, 10))
+		}
+		if region.Name == "" {
+			region.Name = people[j].FullName()
+		}
+		if !slices.Contains(linked, *region.PersonID) {
+			linked = append(linked, *region.PersonID)
+		}
+	}
+	photo.People = linked
+	return http.StatusOK, nil
+}
+
+// GetPersonPhotos Get a page of the photos of a person in the family tree, along with any other filters
+func (s *service) GetPersonPhotos(id int64, q *PhotoQuery) (*PhotoPage, int, error) {
+	_, err := s.fs.GetPerson(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("person does not exist")
+	}
+	if err != nil {
+		log.Println("could not get person. ID: "+strconv.FormatInt(id, 10), err)
+		return nil, http.StatusInternalServerError, errors.New("could not get person")
+	}
+	if !slices.Contains(q.People, id) {
+		q.People = append(q.People, id)
+	}
+	return s.SearchPhotos(q)
+}
+
+// ------------------- Handlers -------------------
+
+// GetPersonPhotos Get the photos of the person in the path, filtered and paged like GetPhotosJSON
+func GetPersonPhotos(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			responses.BadRequest(w, r, "invalid person ID")
+			return
+		}
+		q, err := PhotoQueryFromValues(r.URL.Query())
+		if err != nil {
+			log.Println("invalid photo query", err)
+			responses.BadRequest(w, r, err.Error())
+			return
+		}
+		page, status, err := s.GetPersonPhotos(id, q)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		page.SetLinks(r)
+		page.SetLinkHeader(w)
+		if WantsGeoJSON(r) {
+			responses.GeoJSON(w, r, NewFeatureCollection(page.Photos))
+			return
+		}
+		responses.StructOK(w, r, page)
+	}
+}
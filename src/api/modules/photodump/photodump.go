@@ -1,13 +1,17 @@
 package photodump
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"home_api/src/api/modules/familytree"
+	"home_api/src/api/modules/tags"
 	"home_api/src/database"
+	"home_api/src/proto/problempb"
 	"home_api/src/responses"
 	"home_api/src/web"
 	"image"
@@ -18,140 +22,244 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/chai2010/webp"
 	"github.com/corona10/goimagehash"
+	"github.com/gen2brain/avif"
+	"github.com/gen2brain/heic"
 	"github.com/goccy/go-json"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/kolesa-team/goexiv"
 	"github.com/minio/minio-go/v7"
 )
 
 // ------------------- Types -------------------
 
-// Tags Type alias for the Tags "enum"
-type Tags string
-
-const (
-	Sparkly   Tags = "sparkly"
-	Christmas Tags = "christmas"
-)
-
 // Photo Struct for a photo
 type Photo struct {
-	ID          string    `json:"id" db:"id"`
-	File        string    `json:"file" db:"file"`
-	Ext         string    `json:"ext" db:"ext"`
-	Hash        string    `json:"hash" db:"hash"`
-	PHash       []byte    `json:"phash" db:"phash"`
-	Description string    `json:"description" db:"description"`
-	Source      string    `json:"source" db:"source"`
-	Subjects    []string  `json:"subjects" db:"subjects"`
-	Tags        []Tags    `json:"tags" db:"tags"`
-	Resolution  string    `json:"resolution" db:"resolution"`
-	TakenAt     time.Time `json:"taken_at" db:"taken_at"`
-	UploadedAt  time.Time `json:"uploaded_at" db:"uploaded_at"`
-	ModifiedAt  time.Time `json:"modified_at" db:"modified_at"`
-}
-
-// GetImgData Get the image data from a file and add it to the photo
-func (p *Photo) GetImgData(r io.Reader, bs []byte, contentType string) (int, error) {
-	var err error
-	var img image.Image
-	var ext string
+	ID          string       `json:"id" db:"id"`
+	File        string       `json:"file" db:"file"`
+	Ext         string       `json:"ext" db:"ext"`
+	Hash        string       `json:"hash" db:"hash"`
+	PHash       []byte       `json:"phash" db:"phash"`
+	PHashes     [][]byte     `json:"-" db:"phashes"`
+	Description string       `json:"description" db:"description"`
+	Source      string       `json:"source" db:"source"`
+	Subjects    []string     `json:"subjects" db:"subjects"`
+	Tags        []string     `json:"tags" db:"tags"`
+	Resolution  string       `json:"resolution" db:"resolution"`
+	TakenAt     time.Time    `json:"taken_at" db:"taken_at"`
+	UploadedAt  time.Time    `json:"uploaded_at" db:"uploaded_at"`
+	ModifiedAt  time.Time    `json:"modified_at" db:"modified_at"`
+	VariantOf   *string      `json:"variant_of,omitempty" db:"variant_of"`
+	Derivatives []Derivative `json:"derivatives" db:"derivatives"`
+	Rendition   string       `json:"rendition,omitempty" db:"rendition"`
+
+	CameraMake   string            `json:"camera_make" db:"camera_make"`
+	CameraModel  string            `json:"camera_model" db:"camera_model"`
+	Lens         string            `json:"lens" db:"lens"`
+	ExposureTime string            `json:"exposure_time" db:"exposure_time"`
+	FNumber      *float64          `json:"f_number" db:"f_number"`
+	ISO          *int              `json:"iso" db:"iso"`
+	FocalLength  *float64          `json:"focal_length" db:"focal_length"`
+	Orientation  Orientation       `json:"orientation" db:"orientation"`
+	Latitude     *float64          `json:"latitude" db:"latitude"`
+	Longitude    *float64          `json:"longitude" db:"longitude"`
+	Keywords     []string          `json:"keywords" db:"keywords"`
+	Metadata     map[string]string `json:"metadata" db:"metadata"`
+
+	// TakenAtSource Where TakenAt came from, and TakenAtOffset the UTC offset in seconds it was taken in
+	TakenAtSource TimeSource `json:"taken_at_source" db:"taken_at_source"`
+	TakenAtOffset *int       `json:"taken_at_offset" db:"taken_at_offset"`
+
+	// People The IDs of the family tree people the subjects and regions name, worked out again whenever they change
+	People []int64 `json:"people" db:"people"`
+
+	// Regions The labelled rectangles on the photo, eg. faces, read from the metadata or drawn by hand
+	Regions []Region `json:"regions" db:"regions"`
+
+	// DeletedAt When the photo was moved to the trash, trashed photos are hidden until they're restored or purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+}
+
+// LikePhoto A Photo along with its Hamming distance from a reference phash
+type LikePhoto struct {
+	Photo
+	Distance int `json:"distance" db:"distance"`
+}
+
+// UploadResult The outcome of uploading one file
+type UploadResult struct {
+	File        string             `json:"file"`
+	Status      int                `json:"status"`
+	ID          string             `json:"id,omitempty"`
+	DuplicateOf []string           `json:"duplicate_of,omitempty"`
+	Problem     *problempb.Problem `json:"problem,omitempty"`
+
+	photo *Photo
+	err   error
+}
+
+// uploadReader Remembers the first error from reading an upload, since decoders tend to hide it
+type uploadReader struct {
+	r   io.Reader
+	err error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err != nil && err != io.EOF && u.err == nil {
+		u.err = err
+	}
+	return n, err
+}
+
+// limitedReader Fails with a MaxBytesError once more than limit bytes have been read,
+// unlike io.LimitReader which quietly stops
+type limitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n > l.limit {
+		return 0, &http.MaxBytesError{Limit: l.limit}
+	}
+	// Read one byte past the limit, so a file of exactly the limit isn't rejected
+	if room := l.limit - l.n + 1; int64(len(p)) > room {
+		p = p[:room]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, &http.MaxBytesError{Limit: l.limit}
+	}
+	return n, err
+}
+
+// prefixBuffer Keeps the first max bytes written to it, and discards the rest
+type prefixBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	if room := b.max - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// ImageExt The file extension for a supported image type
+func ImageExt(contentType string) (string, bool) {
 	switch contentType {
 	case "image/jpeg":
-		ext = "jpg"
+		return "jpg", true
+	case "image/png":
+		return "png", true
+	case "image/gif":
+		return "gif", true
+	case "image/webp":
+		return "webp", true
+	case "image/heic":
+		return "heic", true
+	case "image/heif":
+		return "heif", true
+	case "image/avif":
+		return "avif", true
+	}
+	return "", false
+}
+
+// DecodeImage Decode an image, returning it along with the file extension for its type
+func DecodeImage(r io.Reader, contentType string) (image.Image, string, error) {
+	var err error
+	var img image.Image
+	ext, ok := ImageExt(contentType)
+	if !ok {
+		return nil, "", errors.New("unsupported image type: " + contentType)
+	}
+	switch ext {
+	case "jpg":
 		img, err = jpeg.Decode(r)
 		break
-	case "image/png":
-		ext = "png"
+	case "png":
 		img, err = png.Decode(r)
 		break
-	case "image/gif":
-		ext = "gif"
+	case "gif":
 		img, err = gif.Decode(r)
 		break
-	case "image/webp":
-		ext = "webp"
+	case "webp":
 		img, err = webp.Decode(r)
 		break
-	default:
-		log.Println("unsupported image type: " + contentType + ". ID: " + p.ID)
-		return http.StatusBadRequest, errors.New("unsupported image type: " + contentType)
+	case "heic", "heif":
+		img, err = heic.Decode(r)
+		break
+	case "avif":
+		img, err = avif.Decode(r)
+		break
 	}
 	if err != nil {
-		log.Println("error reading image. ID: "+p.ID, err)
-		return http.StatusBadRequest, errors.New("error reading image")
+		log.Println("error reading image", err)
+		return nil, "", errors.New("error reading image")
+	}
+	return img, ext, nil
+}
+
+// GetImgData Get the image data from a file and add it to the photo, returning the upright image
+func (p *Photo) GetImgData(r io.Reader, bs []byte, contentType string) (image.Image, int, error) {
+	img, ext, err := DecodeImage(r, contentType)
+	if err != nil {
+		log.Println("could not decode image. ID: "+p.ID, err)
+		return nil, http.StatusBadRequest, err
 	}
 	p.Ext = ext
+	p.Hash = HashBytes(bs)
+	img, err = p.SetImgData(img, ImageOrientation(ext, bs))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return img, http.StatusCreated, nil
+}
+
+// SetImgData Add the data derived from a decoded image to the photo, returning the upright image
+func (p *Photo) SetImgData(img image.Image, o Orientation) (image.Image, error) {
+	img = Orient(img, o)
 
 	ph, err := goimagehash.PerceptionHash(img)
 	if err != nil {
 		log.Println("error generating phash. ID: "+p.ID, err)
-		return http.StatusBadRequest, errors.New("error generating phash")
+		return nil, errors.New("error generating phash")
+	}
+	p.PHash = PHashBytes(ph)
+	p.PHashes, err = OrientedPHashes(img)
+	if err != nil {
+		log.Println("error generating oriented phashes. ID: "+p.ID, err)
+		return nil, errors.New("error generating phash")
 	}
-	iph := ph.GetHash()
-	phash := make([]byte, 8)
-	binary.LittleEndian.PutUint64(phash, iph)
-	p.PHash = phash
-
-	sha := sha256.Sum256(bs)
-	p.Hash = hex.EncodeToString(sha[:])
 
 	w := strconv.Itoa(img.Bounds().Dx())
 	h := strconv.Itoa(img.Bounds().Dy())
 	p.Resolution = w + "x" + h + "p"
 
 	log.Println("photo data aquired. ID: " + p.ID)
-	return http.StatusCreated, nil
-}
-
-// GetExivData Get Exiv2 data from a file and and add it to the photo
-func (p *Photo) GetExivData(bs []byte) error {
-	img, err := goexiv.OpenBytes(bs)
-	if err == nil {
-		err = img.ReadMetadata()
-		if err == nil {
-			// "yyyy:MM:dd HH:mm:ss"
-			var dt string
-			exif := img.GetExifData().AllTags()
-			dt = exif["Exif.Image.DateTimeOriginal"]
-			if dt == "" {
-				dt = exif["Exif.Photo.DateTimeOriginal"]
-			}
-			if dt == "" {
-				iptc := img.GetIptcData().AllTags()
-				dt = iptc["Date Created"]
-			}
-			if dt != "" {
-				dateStr := strings.Replace(dt, ":", "-", 2)
-				t, err := time.Parse(time.DateTime, dateStr)
-				if err == nil {
-					p.TakenAt = t
-				}
-			}
-		} else {
-			log.Println("could not retrieve photo metadata. ID: "+p.ID, err)
-		}
-	} else {
-		log.Println("could not retrieve photo metadata. ID: "+p.ID, err)
-	}
-	return nil
+	return img, nil
 }
 
-// TagsString Converts the tags to strings, because type safety
-func (p *Photo) TagsString() []string {
-	var tags []string
-	for _, tag := range p.Tags {
-		tags = append(tags, string(tag))
+// OrientedPHashes The phashes of the photo in every orientation, or just its phash for older photos
+func (p *Photo) OrientedPHashes() [][]byte {
+	if len(p.PHashes) == 0 {
+		return [][]byte{p.PHash}
 	}
-	return tags
+	return p.PHashes
 }
 
 // EnsureNonNil Ensures that the struct doesn't have nil fields with no defaults
@@ -160,18 +268,84 @@ func (p *Photo) EnsureNonNil() {
 		p.Subjects = make([]string, 0)
 	}
 	if p.Tags == nil {
-		p.Tags = make([]Tags, 0)
+		p.Tags = make([]string, 0)
+	}
+	if p.People == nil {
+		p.People = make([]int64, 0)
+	}
+	if p.Regions == nil {
+		p.Regions = make([]Region, 0)
+	}
+	if p.Derivatives == nil {
+		p.Derivatives = make([]Derivative, 0)
+	}
+	if p.Orientation == 0 {
+		p.Orientation = Normal
+	}
+	if p.Keywords == nil {
+		p.Keywords = make([]string, 0)
+	}
+	if p.Metadata == nil {
+		p.Metadata = make(map[string]string)
 	}
 }
 
 // Unrwap Unwraps the Photo struct into an array of fields
 func (p *Photo) Unwrap() []any {
 	p.EnsureNonNil()
-	return []any{p.ID, p.File, p.Ext, p.Hash, p.PHash,
+	return []any{p.ID, p.File, p.Ext, p.Hash, p.PHash, p.PHashes,
 		p.Description, p.Source, p.Subjects, p.Tags,
-		p.Resolution, p.TakenAt, p.UploadedAt, p.ModifiedAt}
+		p.Resolution, p.TakenAt, p.UploadedAt, p.ModifiedAt, p.VariantOf,
+		p.Derivatives, p.Rendition,
+		p.CameraMake, p.CameraModel, p.Lens, p.ExposureTime, p.FNumber, p.ISO, p.FocalLength,
+		p.Orientation, p.Latitude, p.Longitude, p.Keywords, p.Metadata,
+		p.TakenAtSource, p.TakenAtOffset, p.People, p.Regions}
 }
 
+// -------------- Globals --------------
+
+// ExifHeaderSize How much of the start of an upload is kept for reading EXIF data
+const ExifHeaderSize = 256 << 10
+
+// S3PartSize The part size used when streaming uploads of unknown size to S3
+const S3PartSize = 16 << 20
+
+// MaxFieldSize The largest non-file form field accepted in an upload
+const MaxFieldSize = 64 << 10
+
+// photoColumns The columns of a Photo, every column but the full-text search vector, which is only used by queries
+const photoColumns = `id, file, ext, hash, phash, phashes, description, source, subjects, tags, resolution,
+taken_at, uploaded_at, modified_at, variant_of, derivatives, rendition,
+camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length, orientation, latitude, longitude,
+keywords, metadata, taken_at_source, taken_at_offset, people, regions, deleted_at`
+
+var maxUploadSize = func() int64 {
+	str := os.Getenv("PHOTO_MAX_UPLOAD_SIZE")
+	if str == "" {
+		return 512 << 20
+	}
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || size < 1 {
+		log.Println("Invalid PHOTO_MAX_UPLOAD_SIZE, defaulting to 512MiB")
+		return 512 << 20
+	}
+	return size
+}()
+
+// maxZipEntries The most entries a zip archive in an upload can have, folders and skipped files included
+var maxZipEntries = func() int {
+	str := os.Getenv("PHOTO_MAX_ZIP_ENTRIES")
+	if str == "" {
+		return 1000
+	}
+	entries, err := strconv.Atoi(str)
+	if err != nil || entries < 1 {
+		log.Println("Invalid PHOTO_MAX_ZIP_ENTRIES, defaulting to 1000")
+		return 1000
+	}
+	return entries
+}()
+
 // ------------------- Store -------------------
 
 // PhotoStore Interface for the photo store
@@ -179,16 +353,72 @@ type PhotoStore interface {
 	GetPhotoById(id string) (*Photo, error)
 	GetPhotoByHash(hash string) (*Photo, error)
 	CreatePhoto(photo *Photo) error
-	UpdatePhoto(photo *Photo) error
-	DeletePhoto(id string) error
-
-	CountLikePhotos(phash []byte, hd int) (int, error)
-	// GetLikePhotos(phash []byte, hd int, limit int) ([]*Photo, error)
-
-	GetPhotosByDate(start time.Time, end time.Time, amount int, cursor int) ([]*Photo, error)
+	UpdatePhoto(photo *Photo, modifiedAt time.Time) (bool, error)
+	DeletePhoto(photo *Photo) error
+
+	CountLikePhotos(phashes [][]byte, hd int) (int, error)
+	GetLikePhotos(phashes [][]byte, hd int, limit int) ([]*LikePhoto, error)
+	RelinkVariants(from []string, to string) error
+	Retag(from []string, to string) (int64, error)
+
+	SearchPhotos(q *PhotoQuery, limit int) ([]*FoundPhoto, error)
+	GetCameras() ([]*Camera, error)
+	GetPhotosNear(lat float64, lon float64, radiusKm float64, limit int) ([]*NearPhoto, error)
+	GetPhotosInBox(box BoundingBox, limit int) ([]*Photo, error)
+
+	GetAlbums() ([]*Album, error)
+	GetAlbumById(id string) (*Album, error)
+	CreateAlbum(album *Album) error
+	UpdateAlbum(album *Album) error
+	DeleteAlbum(id string) error
+	ReorderAlbums(ids []string) error
+	GetAlbumPhotos(id string) ([]*Photo, error)
+	AddAlbumPhotos(id string, photoIDs []string) (int64, error)
+	RemoveAlbumPhoto(id string, photoID string) (int64, error)
+	ReorderAlbumPhotos(id string, photoIDs []string) error
+	HasAlbumPhoto(id string, photoID string) (bool, error)
+
+	GetSmartAlbums() ([]*SmartAlbum, error)
+	GetSmartAlbumById(id string) (*SmartAlbum, error)
+	CreateSmartAlbum(album *SmartAlbum) error
+	UpdateSmartAlbum(album *SmartAlbum) error
+	DeleteSmartAlbum(id string) error
 
 	UploadPhotoToS3(photo *Photo, r io.Reader, length int64, contentType string) error
-	DeletePhotoFromS3(photo *Photo) error
+	UploadDerivativeToS3(photo *Photo, d *Derivative, bs []byte) error
+	DeleteDerivativesFromS3(photo *Photo) error
+	UploadRenditionToS3(photo *Photo, ext string, contentType string, bs []byte) error
+	DeleteRenditionFromS3(photo *Photo) error
+	GetPhotoFromS3(photo *Photo) ([]byte, error)
+
+	UpdatePhotoDerivatives(photo *Photo) (bool, error)
+	UpdatePhotoRendition(photo *Photo) (bool, error)
+	UpdatePhotoMetadata(photo *Photo, modifiedAt time.Time) (bool, error)
+	UpdatePhotoHashes(photo *Photo) error
+	UpdatePhotoTrash(photo *Photo, removed []string) error
+
+	GetTrashedPhotos() ([]*Photo, error)
+	GetExpiredTrash(before time.Time, limit int) ([]*Photo, error)
+	CopyPhotoInS3(photo *Photo, from string, to string) error
+	DeleteObjectFromS3(object string) error
+
+	QueueObjectDeletions(photoID string, objects []string, runAt time.Time) error
+	ClaimObjectDeletions(limit int) ([]*ObjectDeletion, error)
+	CompleteObjectDeletion(deletion *ObjectDeletion) error
+	UpdateObjectDeletion(deletion *ObjectDeletion) error
+	GetOutboxObjects() ([]string, error)
+	ListObjectsInS3() ([]StoredObject, error)
+	ObjectExistsInS3(object string) (bool, error)
+	GetAllPhotos() ([]*Photo, error)
+
+	CreateHistoryEntry(entry *HistoryEntry) error
+	GetPhotoHistory(photoID string) ([]*HistoryEntry, error)
+
+	CreateJob(job *Job) error
+	GetJobsByPhoto(photoID string) ([]*Job, error)
+	ClaimJob() (*Job, error)
+	UpdateJob(job *Job) error
+	RenewJobLease(job *Job) error
 }
 
 // store Private implementation of PhotoStore
@@ -204,7 +434,7 @@ func NewStore(db *pgxpool.Pool, s3 *minio.Client) PhotoStore {
 
 // GetPhotoById Get the specified Photo from the database
 func (s *store) GetPhotoById(id string) (*Photo, error) {
-	rows, _ := s.db.Query(context.Background(), "SELECT * FROM photos WHERE id = $1", id)
+	rows, _ := s.db.Query(context.Background(), "SELECT "+photoColumns+" FROM photos WHERE id = $1", id)
 	photo, err := pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[Photo])
 	if err != nil {
 		return nil, err
@@ -213,9 +443,10 @@ func (s *store) GetPhotoById(id string) (*Photo, error) {
 	return photo, err
 }
 
-// GetPhotoByHash Get the specified Photo from the database
+// GetPhotoByHash Get the earliest uploaded Photo with the specified hash from the database, ignoring the trash
 func (s *store) GetPhotoByHash(hash string) (*Photo, error) {
-	rows, _ := s.db.Query(context.Background(), "SELECT * FROM photos WHERE hash = $1", hash)
+	rows, _ := s.db.Query(context.Background(),
+		"SELECT "+photoColumns+" FROM photos WHERE hash = $1 AND deleted_at IS NULL ORDER BY uploaded_at LIMIT 1", hash)
 	photo, err := pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[Photo])
 	if err != nil {
 		return nil, err
@@ -226,87 +457,145 @@ func (s *store) GetPhotoByHash(hash string) (*Photo, error) {
 
 const insertQuery string = `
 INSERT INTO photos
-(id, file, ext, hash, phash,
+(id, file, ext, hash, phash, phashes,
 description, source, subjects, tags,
-resolution, taken_at, uploaded_at, modified_at)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
-
-// CreatePhoto Create a Photo entry in the database
+resolution, taken_at, uploaded_at, modified_at, variant_of,
+derivatives, rendition,
+camera_make, camera_model, lens, exposure_time, f_number, iso, focal_length,
+orientation, latitude, longitude, keywords, metadata,
+taken_at_source, taken_at_offset, people, regions)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17,
+$18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33)`
+
+// CreatePhoto Create a Photo entry in the database, cancelling the deletion its upload queued
 func (s *store) CreatePhoto(p *Photo) error {
-	_, err := s.db.Exec(context.Background(), insertQuery, p.Unwrap()...)
+	args := append(p.Unwrap(), photoObjects(p))
+	_, err := s.db.Exec(context.Background(),
+		"WITH cancelled AS (DELETE FROM photo_outbox WHERE object = ANY($34::TEXT[]))"+insertQuery, args...)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// updateQuery Only sets the fields edits change. Jobs write the rest, and the ones both change only over a row
+// that hasn't been modified since the job read it, so neither overwrites the other.
 const updateQuery = `
 UPDATE photos SET
-file = $2, ext = $3, hash = $4, phash = $5,
-description = $6, source = $7, subjects = $8, tags = $9,
-resolution = $10, taken_at = $11, uploaded_at = $12, modified_at = $13)
-WHERE id = $1`
+description = $2, source = $3, subjects = $4, tags = $5, people = $6, regions = $7,
+taken_at = $8, taken_at_source = $9, taken_at_offset = $10, modified_at = $11
+WHERE id = $1 AND modified_at = $12 AND deleted_at IS NULL`
 
-// UpdatePhoto Update a Photo in the database
-func (s *store) UpdatePhoto(p *Photo) error {
-	_, err := s.db.Exec(context.Background(), updateQuery, p.Unwrap()...)
+// UpdatePhoto Update the editable fields of a Photo in the database,
+// as long as it hasn't been modified since modifiedAt or moved to the trash. Returns whether it was updated.
+func (s *store) UpdatePhoto(p *Photo, modifiedAt time.Time) (bool, error) {
+	p.EnsureNonNil()
+	tag, err := s.db.Exec(context.Background(), updateQuery,
+		p.ID, p.Description, p.Source, p.Subjects, p.Tags, p.People, p.Regions,
+		p.TakenAt, p.TakenAtSource, p.TakenAtOffset, p.ModifiedAt, modifiedAt)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	return tag.RowsAffected() > 0, nil
 }
 
-// DeletePhoto Delete a Photo in the database
-func (s *store) DeletePhoto(id string) error {
-	_, err := s.db.Query(context.Background(),
-		"DELETE FROM photos WHERE id = $1", id)
+const deletePhotoQuery = `
+WITH deleted AS (
+	DELETE FROM photos WHERE id = $1 RETURNING id
+)
+INSERT INTO photo_outbox (object, photo_id, attempts, last_error, run_at, created_at)
+SELECT object, $1, 0, '', NOW(), NOW() FROM UNNEST($2::TEXT[]) AS object
+WHERE EXISTS (SELECT 1 FROM deleted)
+ON CONFLICT (object) DO UPDATE SET attempts = 0, claimed = FALSE, last_error = '', run_at = EXCLUDED.run_at`
+
+// DeletePhoto Delete a Photo in the database, and queue the deletion of its objects from S3
+func (s *store) DeletePhoto(p *Photo) error {
+	_, err := s.db.Exec(context.Background(), deletePhotoQuery, p.ID, photoObjects(p))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// retagSQL Apply a retag to an array of tags, keeping the order and dropping repeats and removed tags
+func retagSQL(source string) string {
+	return `ARRAY(
+	SELECT tag FROM (
+		SELECT CASE WHEN tag = ANY($1::TEXT[]) THEN $2::TEXT ELSE tag END AS tag, ord
+		FROM ` + source + ` WITH ORDINALITY AS t(tag, ord)
+	) AS retagged
+	WHERE tag <> ''
+	GROUP BY tag
+	ORDER BY MIN(ord))`
+}
+
+// Retag Replace tags on every photo, and in the saved queries of smart albums, removing them if to is empty
+func (s *store) Retag(from []string, to string) (int64, error) {
+	// The smart albums are retagged in the same statement, so the two can't get out of step
+	tag, err := s.db.Exec(context.Background(),
+		"WITH albums AS (UPDATE smart_albums SET query = jsonb_set(query, '{tags}', to_jsonb("+
+			retagSQL("jsonb_array_elements_text(query->'tags')")+")), modified_at = NOW() "+
+			"WHERE query->'tags' ?| $1::TEXT[])\n"+
+			"UPDATE photos SET tags = "+retagSQL("UNNEST(tags)")+", modified_at = NOW() WHERE tags && $1::TEXT[]",
+		from, to)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
 const checkpHashQuery = `
 SELECT COUNT(*) FROM photos
-WHERE BIT_COUNT(xor_digests(phash, $1)) <= $2`
+WHERE deleted_at IS NULL AND EXISTS (
+	SELECT 1 FROM UNNEST($1::BYTEA[]) AS h
+	WHERE BIT_COUNT(xor_digests(phash, h)) <= $2)`
 
-// CountLikePhotos Return the number of similar photos
-func (s *store) CountLikePhotos(phash []byte, hd int) (int, error) {
-	// TODO: Compare rotated hashes? (90deg, 180deg)
+// CountLikePhotos Return the number of photos similar to any of the given phashes
+func (s *store) CountLikePhotos(phashes [][]byte, hd int) (int, error) {
 	var count int
-	err := s.db.QueryRow(context.Background(), checkpHashQuery, phash, hd).Scan(&count)
+	err := s.db.QueryRow(context.Background(), checkpHashQuery, phashes, hd).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-const getPhotosByTimeTakenQuery = `
-SELECT * FROM photos
-WHERE taken_at BETWEEN $1 AND $2
-ORDER BY taken_at DESC
-LIMIT $3 OFFSET $4`
-
-// GetPhotosByDate Get a list of photos based on the time taken
-func (s *store) GetPhotosByDate(start time.Time, end time.Time, amount int, cursor int) ([]*Photo, error) {
-	// var photos []*Photo = make([]*Photo, amount)
-	rows, err := s.db.Query(context.Background(),
-		getPhotosByTimeTakenQuery, start, end, amount, amount*cursor)
+const getLikePhotosQuery = `
+SELECT * FROM (
+	SELECT ` + photoColumns + `, (
+		SELECT MIN(BIT_COUNT(xor_digests(photos.phash, h)))
+		FROM UNNEST($1::BYTEA[]) AS h) AS distance
+	FROM photos
+	WHERE deleted_at IS NULL) AS like_photos
+WHERE distance <= $2
+ORDER BY distance ASC, taken_at DESC
+LIMIT NULLIF($3, 0)`
+
+// GetLikePhotos Get the photos within the given Hamming distance of any of the phashes, closest first
+func (s *store) GetLikePhotos(phashes [][]byte, hd int, limit int) ([]*LikePhoto, error) {
+	rows, err := s.db.Query(context.Background(), getLikePhotosQuery, phashes, hd, limit)
 	if err != nil {
 		return nil, err
 	}
-	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[LikePhoto])
 	if err != nil {
 		return nil, err
 	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
 	return photos, nil
 }
 
-// UploadPhotoToS3 Upload a photo to S3
+// UploadPhotoToS3 Upload a photo to S3, use a length of -1 to stream a photo of unknown size
 func (s *store) UploadPhotoToS3(photo *Photo, r io.Reader, length int64, contentType string) error {
+	opts := minio.PutObjectOptions{ContentType: contentType}
+	if length < 0 {
+		// Otherwise minio sizes each part for the largest possible object, and buffers that much
+		opts.PartSize = S3PartSize
+	}
 	_, err := s.s3.PutObject(
-		context.Background(), "photos", photo.ID+"."+photo.Ext, r, length,
-		minio.PutObjectOptions{ContentType: contentType})
+		context.Background(), "photos", photo.ID+"."+photo.Ext, r, length, opts)
 	if err != nil {
 		return err
 	}
@@ -314,38 +603,71 @@ func (s *store) UploadPhotoToS3(photo *Photo, r io.Reader, length int64, content
 	return nil
 }
 
-// DeletePhotoFromS3 Delete a photo from S3
-func (s *store) DeletePhotoFromS3(photo *Photo) error {
-	err := s.s3.RemoveObject(
-		context.Background(), "photos", photo.ID+"."+photo.Ext,
-		minio.RemoveObjectOptions{})
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 // ------------------- Service -------------------
 
 // PhotoService Interface for the photo service
 type PhotoService interface {
 	GetPhotoById(id string) (*Photo, int, error)
 	GetPhotoByHash(hash string) (*Photo, int, error)
-	UploadPhoto(photo *Photo, file *os.File) (int, error)
-	EditPhoto(photo *Photo) (int, error)
-	SafeDeletePhoto(id string, confirm string) (int, error)
-
-	GetPhotosByDate(start time.Time, end time.Time, amount int, cursor int) ([]*Photo, int, error)
+	UploadPhoto(photo *Photo, r io.Reader, modTime time.Time, opts UploadOptions) (int, error)
+	EditPhoto(photo *Photo, actor string) (int, error)
+	PatchPhoto(id string, patch *PhotoPatch, ifMatch string, actor string) (*Photo, int, error)
+	SafeDeletePhoto(id string, confirm string, actor string) (int, error)
+	GetPhotoHistory(id string) ([]*HistoryEntry, int, error)
+	RevertPhoto(id string, entryID string, actor string) (*Photo, int, error)
+	DownloadPhoto(id string) (*Photo, []byte, int, error)
+	GetTrash() ([]*Photo, int, error)
+	RestorePhoto(id string, actor string) (*Photo, int, error)
+	PurgePhoto(id string, confirm string) (int, error)
+
+	SearchPhotos(q *PhotoQuery) (*PhotoPage, int, error)
+	GetCameras() ([]*Camera, int, error)
+	GetPhotosNear(lat float64, lon float64, radiusKm float64, limit int) ([]*NearPhoto, int, error)
+	GetPhotosInBox(box BoundingBox, limit int) ([]*Photo, int, error)
+	GetLikePhotos(phashes [][]byte, hd int, limit int) ([]*LikePhoto, int, error)
+	GetSimilarPhotos(id string, hd int, limit int) ([]*LikePhoto, int, error)
+
+	GetAlbums() ([]*Album, int, error)
+	GetAlbumById(id string) (*Album, int, error)
+	CreateAlbum(album *Album) (int, error)
+	EditAlbum(album *Album) (*Album, int, error)
+	DeleteAlbum(id string) (int, error)
+	ReorderAlbums(ids []string) ([]*Album, int, error)
+	GetAlbumPhotos(id string) ([]*Photo, int, error)
+	AddAlbumPhotos(id string, photoIDs []string) ([]*Photo, int, error)
+	RemoveAlbumPhoto(id string, photoID string) (int, error)
+	ReorderAlbumPhotos(id string, photoIDs []string) ([]*Photo, int, error)
+
+	GetSmartAlbums() ([]*SmartAlbum, int, error)
+	GetSmartAlbumById(id string) (*SmartAlbum, int, error)
+	CreateSmartAlbum(album *SmartAlbum) (int, error)
+	EditSmartAlbum(album *SmartAlbum) (*SmartAlbum, int, error)
+	DeleteSmartAlbum(id string) (int, error)
+	GetSmartAlbumPhotos(id string, values url.Values) (*PhotoPage, int, error)
+
+	GetPeople() []*familytree.Person
+	GetPersonPhotos(id int64, q *PhotoQuery) (*PhotoPage, int, error)
+	SetPhotoRegions(id string, regions []Region, actor string) (*Photo, int, error)
+
+	QueuePhotoJob(photoID string, kind JobKind) (*Job, int, error)
+	GetPhotoJobs(photoID string) ([]*Job, int, error)
+	RunJobs(ctx context.Context)
+	Reconcile(repair bool) (*ReconcileReport, int, error)
 }
 
 // service Private PhotoService implementation
 type service struct {
-	ps PhotoStore
+	ps     PhotoStore
+	ts     tags.TagService
+	fs     *familytree.Store
+	wake   chan struct{}
+	outbox chan struct{}
 }
 
-// NewService Creates a new PhotoService
-func NewService(ps PhotoStore) PhotoService {
-	return &service{ps}
+// NewService Creates a new PhotoService, checking photo tags against the shared tag vocabulary
+// and linking subjects to the people in the family tree
+func NewService(ps PhotoStore, ts tags.TagService, fs *familytree.Store) PhotoService {
+	return &service{ps, ts, fs, make(chan struct{}, 1), make(chan struct{}, 1)}
 }
 
 // GetPhotoById Get the specified Photo from the database
@@ -356,124 +678,217 @@ func (s *service) GetPhotoById(id string) (*Photo, int, error) {
 		log.Println("could not get photo. ID: "+id, err)
 		return nil, http.StatusNotFound, errors.New("photo does not exist")
 	}
+	if photo.DeletedAt != nil {
+		return nil, http.StatusNotFound, errors.New("photo is in the trash")
+	}
 	log.Println("got photo by id. ID: " + photo.ID)
 	return photo, http.StatusOK, nil
 }
 
 // GetPhotoByHash Get the specified Photo from the database
 func (s *service) GetPhotoByHash(hash string) (*Photo, int, error) {
-	// TODO: Differentiate between Server and Client caused db Errors
-	photo, err := s.ps.GetPhotoByHash(hash)
+	if !ValidHash(hash) {
+		return nil, http.StatusBadRequest, errors.New("hash must be a hex encoded SHA-256 digest")
+	}
+	photo, err := s.ps.GetPhotoByHash(strings.ToLower(hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("photo does not exist")
+	}
 	if err != nil {
 		log.Println("could not get photo. Hash: "+hash, err)
-		return nil, http.StatusNotFound, errors.New("photo does not exist")
+		return nil, http.StatusInternalServerError, errors.New("could not get photo")
 	}
 	log.Println("got photo by hash. ID: " + photo.ID)
 	return photo, http.StatusOK, nil
 }
 
-// UploadPhoto Upload a new Photo
-func (s *service) UploadPhoto(photo *Photo, file *os.File) (int, error) {
+// UploadPhoto Upload a new Photo, handling duplicates according to the options.
+// The file is streamed through hashing, decoding and S3 in a single pass.
+func (s *service) UploadPhoto(photo *Photo, r io.Reader, modTime time.Time, opts UploadOptions) (int, error) {
 	// TODO: Differentiate between Server and Client caused db Errors
+	photoTags, status, err := s.ts.NormalizeTags(photo.Tags)
+	if err != nil {
+		return status, err
+	}
+	photo.Tags = photoTags
 	id, err := database.GenSnowflake()
 	if err != nil {
 		log.Println("could not generate id", err)
 		return http.StatusInternalServerError, errors.New("could not generate id")
 	}
 	photo.ID = id
+	status, err = namePeople(photo, opts.People)
+	if err != nil {
+		return status, err
+	}
+	status, err = linkPeople(photo, opts.People)
+	if err != nil {
+		return status, err
+	}
 	photo.UploadedAt = time.Now()
-
-	bs, err := io.ReadAll(file)
-	if err != nil && err != io.EOF {
-		log.Println("could not read file contents. ID: "+photo.ID, err)
-		return http.StatusBadRequest, errors.New("could not read file contents")
+	if photo.TakenAtSource != ManualTime {
+		photo.SetTakenAt(modTime, FilesystemTime)
 	}
-	if len(bs) == 0 {
-		log.Println("file is empty. ID: "+photo.ID, err)
+	photo.ModifiedAt = modTime
+
+	src := &uploadReader{r: r}
+	br := bufio.NewReader(src)
+	head, _ := br.Peek(512)
+	if len(head) == 0 {
+		if src.err != nil {
+			return uploadReadError(photo, src.err)
+		}
+		log.Println("file is empty. ID: " + photo.ID)
 		return http.StatusBadRequest, errors.New("file is empty")
 	}
+	contentType := DetectImageType(head)
+	ext, ok := ImageExt(contentType)
+	if !ok {
+		log.Println("file is not a supported image: " + contentType + ". ID: " + photo.ID)
+		return http.StatusBadRequest, errors.New("file is not a supported image: " + contentType)
+	}
+	photo.Ext = ext
 
-	info, err := file.Stat()
+	// Saving the row cancels this, so the object is only left behind if that never happens
+	err = s.ps.QueueObjectDeletions(photo.ID, []string{photoObject(photo)}, time.Now().Add(OutboxUploadGrace))
 	if err != nil {
-		log.Println("could not read file info. ID: "+photo.ID, err)
-		return http.StatusBadRequest, errors.New("could not read file info")
+		log.Println("could not queue upload in the outbox. ID: "+photo.ID, err)
+		return http.StatusInternalServerError, errors.New("could not upload photo")
 	}
-	photo.TakenAt = info.ModTime()
-	photo.ModifiedAt = info.ModTime()
 
-	contentType := http.DetectContentType(bs)
-	if contentType[:6] != "image/" {
-		log.Println("file is not an image: " + contentType + ". ID: " + photo.ID)
-		return http.StatusBadRequest, errors.New("file is not an image: " + contentType)
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		err := s.ps.UploadPhotoToS3(photo, pr, -1, contentType)
+		// Unblock the decoder if the upload gives up early
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	sha := sha256.New()
+	exifHeader := &prefixBuffer{max: ExifHeaderSize}
+	tee := io.TeeReader(br, io.MultiWriter(sha, exifHeader, pw))
+	img, _, err := DecodeImage(tee, contentType)
+	if err == nil {
+		// Decoders don't always read to the end, but the rest still needs hashing and uploading
+		_, err = io.Copy(io.Discard, tee)
 	}
-
-	nbs := make([]byte, len(bs))
-	copy(nbs, bs)
-	status, err := photo.GetImgData(bytes.NewBuffer(nbs), bs, contentType)
 	if err != nil {
+		// Closing the pipe with an error aborts the upload, so nothing is left in S3
+		pw.CloseWithError(err)
+		<-uploaded
+		if src.err != nil {
+			return uploadReadError(photo, src.err)
+		}
+		log.Println("could not read image. ID: "+photo.ID, err)
 		return http.StatusBadRequest, err
 	}
+	photo.Hash = hex.EncodeToString(sha.Sum(nil))
 
-	hd := 0
-	limit := 0
-	count, err := s.ps.CountLikePhotos(photo.PHash, hd)
-	if err != nil {
-		log.Println("failed to count like photos. ID: "+photo.ID, err)
-		return http.StatusInternalServerError, errors.New("failed to count like photos")
-	}
-	if count > limit {
-		log.Println("duplicate image. ID: " + photo.ID)
-		return http.StatusBadRequest, errors.New("duplicate image")
-	}
-
-	err = photo.GetExivData(bs)
+	// S3 only commits the object once the pipe is closed, so everything that can turn the upload away happens first
+	replaced, status, err := s.vetUpload(photo, img, exifHeader.buf, opts)
 	if err != nil {
-		log.Println("Exiv analysis failed. ID: "+photo.ID, err)
+		pw.CloseWithError(err)
+		<-uploaded
+		return status, err
 	}
-
-	nbs = make([]byte, len(bs))
-	copy(nbs, bs)
-	err = s.ps.UploadPhotoToS3(photo, bytes.NewBuffer(nbs), info.Size(), contentType)
-	if err != nil {
-		log.Println("could not upload photo to S3. ID: "+photo.ID, err)
+	pw.Close()
+	uploadErr := <-uploaded
+	if uploadErr != nil {
+		log.Println("could not upload photo to S3. ID: "+photo.ID, uploadErr)
 		return http.StatusInternalServerError, errors.New("could not upload photo to S3")
 	}
 
 	err = s.ps.CreatePhoto(photo)
 	if err != nil {
 		log.Println("could not upload photo. ID: "+photo.ID, err)
-		err = s.ps.DeletePhotoFromS3(photo)
+		s.discardUpload(photo)
+		return http.StatusInternalServerError, errors.New("could not upload photo")
+	}
+	s.removeReplacedPhotos(photo, replaced, opts.Actor)
+
+	// The rest of the processing happens in the background, so large uploads don't time out
+	kinds := []JobKind{MetadataJob, DerivativesJob}
+	if NeedsRendition(photo.Ext) && renditionFormat != "none" {
+		kinds = append(kinds, RenditionJob)
+	}
+	for _, kind := range kinds {
+		_, _, err = s.QueuePhotoJob(photo.ID, kind)
 		if err != nil {
-			log.Println("could not remove photo from S3 after failing to upload photo: ID: "+photo.ID, err)
-			return http.StatusInternalServerError, errors.New("could not remove photo from S3 after failing to upload photo")
+			log.Println("could not queue job for uploaded photo. ID: "+photo.ID+" Kind: "+string(kind), err)
 		}
-		log.Println("removed in-progress upload from S3. ID: " + photo.ID)
-		return http.StatusInternalServerError, errors.New("could not upload photo")
 	}
 	log.Println("photo uploaded successfully. ID: " + photo.ID)
 	return status, nil
 }
 
-// EditPhoto Edit a Photo in the database
-func (s *service) EditPhoto(photo *Photo) (int, error) {
+// discardUpload Delete a photo from S3 that won't be kept now, rather than once the upload's grace period is up.
+// If the outbox can't be reached, the deletion queued by the upload still catches it.
+func (s *service) discardUpload(photo *Photo) {
+	err := s.ps.QueueObjectDeletions(photo.ID, []string{photoObject(photo)}, time.Now())
+	if err != nil {
+		log.Println("could not queue discarded upload for deletion. ID: "+photo.ID, err)
+		return
+	}
+	s.wakeOutbox()
+	log.Println("queued discarded upload for deletion. ID: " + photo.ID)
+}
+
+// vetUpload Check an upload that's been read in full against the photos already stored,
+// returning the photos it replaces
+func (s *service) vetUpload(photo *Photo, img image.Image, exifHeader []byte, opts UploadOptions) ([]*LikePhoto, int, error) {
+	// Identical bytes are a duplicate under every policy but allow
+	if opts.Policy != AllowDuplicates {
+		existing, status, err := s.GetPhotoByHash(photo.Hash)
+		if err == nil {
+			log.Println("identical image already exists. ID: " + photo.ID + " Existing: " + existing.ID)
+			return nil, http.StatusConflict, &DuplicateError{
+				Message: "an identical image already exists", IDs: []string{existing.ID}}
+		}
+		if status != http.StatusNotFound {
+			return nil, status, err
+		}
+	}
+
+	// EXIF lives at the start of the file, so the whole thing doesn't need to be kept around
+	_, err := photo.SetImgData(img, ImageOrientation(photo.Ext, exifHeader))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	likePhotos, err := s.ps.GetLikePhotos(photo.PHashes, opts.Distance, 0)
+	if err != nil {
+		log.Println("failed to get like photos. ID: "+photo.ID, err)
+		return nil, http.StatusInternalServerError, errors.New("failed to get like photos")
+	}
+	return s.applyDuplicatePolicy(photo, likePhotos, opts)
+}
+
+// EditPhoto Replace the editable fields of a Photo in the database with the ones in edit, the rest are left alone
+func (s *service) EditPhoto(edit *Photo, actor string) (int, error) {
 	// TODO: Differentiate between Server and Client caused db Errors
-	photo, status, err := s.GetPhotoById(photo.ID)
+	photo, status, err := s.GetPhotoById(edit.ID)
 	if err != nil {
 		return status, err
 	}
-
-	photo.ModifiedAt = time.Now()
-	err = s.ps.UpdatePhoto(photo)
+	patch := &PhotoPatch{
+		Description: &edit.Description,
+		Source:      &edit.Source,
+		Subjects:    &edit.Subjects,
+		Tags:        &edit.Tags,
+	}
+	if !edit.TakenAt.IsZero() && !edit.TakenAt.Equal(photo.TakenAt) {
+		patch.TakenAt = &edit.TakenAt
+	}
+	status, err = s.savePatch(photo, patch, actor, HistoryEdit)
 	if err != nil {
-		log.Println("could not update photo. ID: "+photo.ID, err)
-		return http.StatusInternalServerError, errors.New("could not update photo")
+		return status, err
 	}
-	log.Println("edited photo. ID: " + photo.ID)
 	return http.StatusNoContent, nil
 }
 
-// SafeDeletePhoto Delete a photo if the confirmation string matches the hash
-func (s *service) SafeDeletePhoto(id string, confirm string) (int, error) {
+// SafeDeletePhoto Move a photo to the trash if the confirmation string matches the hash
+func (s *service) SafeDeletePhoto(id string, confirm string, actor string) (int, error) {
 	// TODO: Differentiate between Server and Client caused db Errors
 	photo, status, err := s.GetPhotoById(id)
 	if err != nil {
@@ -482,78 +897,356 @@ func (s *service) SafeDeletePhoto(id string, confirm string) (int, error) {
 	if photo.Hash != confirm {
 		return http.StatusBadRequest, errors.New("confirmation hash does not match photo hash")
 	}
-	err = s.ps.DeletePhotoFromS3(photo)
+	status, err = s.trashPhoto(photo)
 	if err != nil {
-		log.Println("could not remove photo from S3", err)
-		return http.StatusInternalServerError, errors.New("could not remove photo from S3")
+		return status, err
+	}
+	s.recordHistory(photo.ID, HistoryDelete, actor, nil)
+	return status, nil
+}
+
+// GetLikePhotos Get the photos whose phash is within the given Hamming distance of any of the phashes
+func (s *service) GetLikePhotos(phashes [][]byte, hd int, limit int) ([]*LikePhoto, int, error) {
+	if hd < 0 || hd > MaxLikeDistance {
+		return nil, http.StatusBadRequest, errors.New("distance must be between 0 and " + strconv.Itoa(MaxLikeDistance))
 	}
-	err = s.ps.DeletePhoto(id)
+	photos, err := s.ps.GetLikePhotos(phashes, hd, limit)
 	if err != nil {
-		log.Println("could not delete photo", err)
-		return http.StatusInternalServerError, errors.New("could not delete photo")
+		log.Println("could not get like photos", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get like photos")
 	}
-	return http.StatusNoContent, nil
+	return photos, http.StatusOK, nil
 }
 
-// GetPhotosByDate Get photos based on the timestamps provided, with pagination
-func (s *service) GetPhotosByDate(start time.Time, end time.Time, amount int, cursor int) ([]*Photo, int, error) {
-	photos, err := s.ps.GetPhotosByDate(start, end, amount, cursor-1)
+// GetSimilarPhotos Get the photos that look like the specified Photo, excluding itself
+func (s *service) GetSimilarPhotos(id string, hd int, limit int) ([]*LikePhoto, int, error) {
+	photo, status, err := s.GetPhotoById(id)
 	if err != nil {
-		log.Println("could not get photos in the specified time range", err)
-		return nil, http.StatusInternalServerError, errors.New("could not get photos in the specified time range")
+		return nil, status, err
 	}
+	// Ask for one extra, since the reference photo is always a match
+	if limit > 0 {
+		limit++
+	}
+	likePhotos, status, err := s.GetLikePhotos(photo.OrientedPHashes(), hd, limit)
+	if err != nil {
+		return nil, status, err
+	}
+	photos := make([]*LikePhoto, 0, len(likePhotos))
+	for _, likePhoto := range likePhotos {
+		if likePhoto.ID != photo.ID {
+			photos = append(photos, likePhoto)
+		}
+	}
+	if limit > 0 && len(photos) > limit-1 {
+		photos = photos[:limit-1]
+	}
+	log.Println("got similar photos. ID: " + photo.ID)
 	return photos, http.StatusOK, nil
 }
 
 // ------------------- Functions -------------------
 
-// CreatePhotoFromFormData - Create a new photo from form data
-func CreatePhotoFromFormData(s PhotoService, r *http.Request) (*Photo, int, error) {
+// uploadReadError The status and error to report for a failure to read an upload
+func uploadReadError(photo *Photo, err error) (int, error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		log.Println("upload is too large. ID: " + photo.ID)
+		return http.StatusRequestEntityTooLarge, errors.New("upload exceeds the maximum size of " + strconv.FormatInt(maxErr.Limit, 10) + " bytes")
+	}
+	log.Println("could not read file contents. ID: "+photo.ID, err)
+	return http.StatusBadRequest, errors.New("could not read file contents")
+}
+
+// DefaultLikeDistance The default Hamming distance used when searching for similar photos
+const DefaultLikeDistance = 10
+
+// MaxLikeDistance The largest possible Hamming distance between two 64 bit phashes
+const MaxLikeDistance = 64
+
+// HashBytes The hex encoded SHA-256 digest used to identify identical files
+func HashBytes(bs []byte) string {
+	sha := sha256.Sum256(bs)
+	return hex.EncodeToString(sha[:])
+}
+
+// ValidHash Whether the string looks like a hex encoded SHA-256 digest
+func ValidHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// QueryInt Parse an integer query parameter, falling back to a default if it's absent
+func QueryInt(r *http.Request, key string, def int) (int, error) {
+	str := r.URL.Query().Get(key)
+	if str == "" {
+		return def, nil
+	}
+	return strconv.Atoi(str)
+}
+
+// ProbePhotoFromFormData Hash an uploaded image without storing it
+func ProbePhotoFromFormData(r *http.Request) (*Photo, int, error) {
 	err := r.ParseMultipartForm(0)
 	if err != nil {
 		log.Println("could not parse form", err)
 		return nil, http.StatusBadRequest, errors.New("could not parse form")
 	}
+	mFile, _, err := r.FormFile("photo")
+	if err != nil {
+		log.Println("file not uploaded")
+		return nil, http.StatusBadRequest, errors.New("file not uploaded")
+	}
+	defer func(file multipart.File) {
+		err := file.Close()
+		if err != nil {
+			log.Println("could not close file", err)
+		}
+	}(mFile)
 
+	bs, err := io.ReadAll(mFile)
+	if err != nil {
+		log.Println("could not read file contents", err)
+		return nil, http.StatusBadRequest, errors.New("could not read file contents")
+	}
+	contentType := DetectImageType(bs)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, http.StatusBadRequest, errors.New("file is not an image: " + contentType)
+	}
 	photo := &Photo{}
-	if desc := r.Form.Get("description"); desc != "" {
+	_, _, err = photo.GetImgData(bytes.NewReader(bs), bs, contentType)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return photo, http.StatusOK, nil
+}
+
+// PhotoFromValues Read the metadata that's applied to every uploaded photo from form values
+func PhotoFromValues(values url.Values) (Photo, error) {
+	photo := Photo{}
+	if takenAt := values.Get("taken_at"); takenAt != "" {
+		t, err := ParseTime(takenAt)
+		if err != nil {
+			return photo, errors.New("invalid taken_at, " + err.Error())
+		}
+		photo.SetTakenAt(t, ManualTime)
+	}
+	if desc := values.Get("description"); desc != "" {
 		photo.Description = desc
 	}
-	if subjects := r.Form.Get("subjects"); subjects != "" {
+	if subjects := values.Get("subjects"); subjects != "" {
 		subjects := strings.Split(subjects, ",")
 		for _, subject := range subjects {
 			photo.Subjects = append(photo.Subjects, subject)
 		}
 	}
-	if tags := r.Form.Get("tags"); tags != "" {
+	if tags := values.Get("tags"); tags != "" {
 		tags := strings.Split(tags, ",")
 		for _, tag := range tags {
-			photo.Tags = append(photo.Tags, Tags(tag))
+			photo.Tags = append(photo.Tags, tag)
 		}
 	}
+	people, err := splitIDs(values.Get("people"))
+	if err != nil {
+		return photo, errors.New("invalid people, " + err.Error())
+	}
+	photo.People = people
+	return photo, nil
+}
 
-	mFile, _, err := r.FormFile("photo")
-	if err == http.ErrMissingFile {
-		log.Println("file not uploaded")
-		return nil, http.StatusBadRequest, errors.New("file not uploaded")
-	} else {
-		file, ok := mFile.(*os.File)
-		if !ok {
-			return nil, http.StatusBadRequest, errors.New("invalid file")
+// uploadFile Upload a single file, recording the outcome
+func uploadFile(s PhotoService, template Photo, name string, r io.Reader, modTime time.Time, opts UploadOptions) *UploadResult {
+	photo := template
+	photo.Subjects = slices.Clone(template.Subjects)
+	photo.Tags = slices.Clone(template.Tags)
+	photo.People = slices.Clone(template.People)
+	result := &UploadResult{File: name}
+
+	status, err := s.UploadPhoto(&photo, r, modTime, opts)
+	result.Status = status
+	var dupErr *DuplicateError
+	if errors.As(err, &dupErr) {
+		result.DuplicateOf = dupErr.IDs
+	}
+	if err != nil {
+		result.err = err
+		result.Problem = responses.NewStatusProblem(status, err.Error()).Problem
+		return result
+	}
+	result.ID = photo.ID
+	result.photo = &photo
+	return result
+}
+
+// failedUpload The result for a file that couldn't be uploaded
+func failedUpload(name string, status int, err error) *UploadResult {
+	return &UploadResult{
+		File:    name,
+		Status:  status,
+		Problem: responses.NewStatusProblem(status, err.Error()).Problem,
+		err:     err,
+	}
+}
+
+// uploadZip Upload every file in a zip archive.
+// Zip archives need random access, so the archive is spooled to a temporary file first.
+// Each entry is held to the upload size limit once decompressed, so a small archive can't expand without bound.
+func uploadZip(s PhotoService, template Photo, name string, r io.Reader, opts UploadOptions) []*UploadResult {
+	tmp, err := os.CreateTemp("", "photo-dump-*.zip")
+	if err != nil {
+		log.Println("could not create temporary file for zip archive: "+name, err)
+		return []*UploadResult{failedUpload(name, http.StatusInternalServerError, errors.New("could not store zip archive"))}
+	}
+	defer func() {
+		err := tmp.Close()
+		if err != nil {
+			log.Println("could not close temporary file", err)
 		}
-		status, err := s.UploadPhoto(photo, file)
+		err = os.Remove(tmp.Name())
 		if err != nil {
-			return nil, status, err
+			log.Println("could not remove temporary file", err)
 		}
+	}()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		status, err := uploadReadError(&Photo{}, err)
+		return []*UploadResult{failedUpload(name, status, err)}
 	}
-	defer func(file multipart.File) {
-		err := file.Close()
+
+	archive, err := zip.NewReader(tmp, size)
+	if err != nil {
+		log.Println("could not read zip archive: "+name, err)
+		return []*UploadResult{failedUpload(name, http.StatusBadRequest, errors.New("could not read zip archive"))}
+	}
+	if len(archive.File) > maxZipEntries {
+		log.Println("zip archive has too many entries: " + name)
+		return []*UploadResult{failedUpload(name, http.StatusRequestEntityTooLarge,
+			errors.New("zip archive has more than "+strconv.Itoa(maxZipEntries)+" entries"))}
+	}
+	var results []*UploadResult
+	for _, entry := range archive.File {
+		base := path.Base(entry.Name)
+		// Skip folders, and the resource forks and dotfiles that macOS likes to add
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		entryName := name + "/" + entry.Name
+		if entry.UncompressedSize64 > uint64(maxUploadSize) {
+			log.Println("zip entry is too large: " + entryName)
+			results = append(results, failedUpload(entryName, http.StatusRequestEntityTooLarge,
+				errors.New("zip entry exceeds the maximum size of "+strconv.FormatInt(maxUploadSize, 10)+" bytes")))
+			continue
+		}
+		f, err := entry.Open()
 		if err != nil {
-			log.Println("could not close file", err)
+			log.Println("could not open zip entry: "+entryName, err)
+			results = append(results, failedUpload(entryName, http.StatusBadRequest, errors.New("could not open zip entry")))
+			continue
 		}
-	}(mFile)
+		// The size in the header can't be trusted
+		limited := &limitedReader{r: f, limit: maxUploadSize}
+		results = append(results, uploadFile(s, template, entryName, limited, fileModTime(entry.Modified), opts))
+		err = f.Close()
+		if err != nil {
+			log.Println("could not close zip entry: "+entryName, err)
+		}
+	}
+	return results
+}
 
-	return photo, http.StatusCreated, nil
+// CreatePhotosFromFormData Create photos from every file in the form data, unpacking zip archives.
+// Parts are streamed as they arrive, so form fields have to come before the files,
+// a field after a file is rejected rather than quietly left unapplied.
+// Fields can also be given in the query string to apply them to every file.
+// Returns whether the request was a bulk upload, ie. more than one file or an archive.
+func CreatePhotosFromFormData(s PhotoService, r *http.Request) ([]*UploadResult, bool, int, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		log.Println("could not parse form", err)
+		return nil, false, http.StatusBadRequest, errors.New("could not parse form")
+	}
+
+	values := r.URL.Query()
+	var results []*UploadResult
+	// The family tree is read once, for every file
+	var people []*familytree.Person
+	peopleRead := false
+	files := 0
+	bulk := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			status, err := uploadReadError(&Photo{}, err)
+			if len(results) == 0 {
+				return nil, false, status, err
+			}
+			// Don't lose track of the files that were already uploaded
+			results = append(results, failedUpload("", status, err))
+			bulk = true
+			break
+		}
+
+		if part.FileName() == "" {
+			if files > 0 {
+				log.Println("form field after a file: " + part.FormName())
+				// The files before it are already stored, so they're reported along with the rejected field
+				results = append(results, failedUpload(part.FormName(), http.StatusBadRequest,
+					errors.New("form field "+part.FormName()+" must come before the files it applies to")))
+				bulk = true
+				break
+			}
+			value, err := io.ReadAll(io.LimitReader(part, MaxFieldSize))
+			if err != nil {
+				log.Println("could not read form field: "+part.FormName(), err)
+				return nil, false, http.StatusBadRequest, errors.New("could not read form field")
+			}
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+		if part.FormName() != "photo" {
+			continue
+		}
+		files++
+
+		opts, err := UploadOptionsFromValues(values)
+		if err != nil {
+			return nil, false, http.StatusBadRequest, err
+		}
+		template, err := PhotoFromValues(values)
+		if err != nil {
+			return nil, false, http.StatusBadRequest, err
+		}
+		if !peopleRead {
+			people = s.GetPeople()
+			peopleRead = true
+		}
+		opts.People = people
+		opts.Actor = requestActor(r)
+
+		br := bufio.NewReader(part)
+		head, _ := br.Peek(512)
+		if http.DetectContentType(head) == "application/zip" {
+			bulk = true
+			results = append(results, uploadZip(s, template, part.FileName(), br, opts)...)
+		} else {
+			results = append(results, uploadFile(s, template, part.FileName(), br, time.Now(), opts))
+		}
+		err = part.Close()
+		if err != nil {
+			log.Println("could not close form part", err)
+		}
+	}
+	if files == 0 {
+		log.Println("file not uploaded")
+		return nil, false, http.StatusBadRequest, errors.New("file not uploaded")
+	}
+	return results, bulk || files > 1, http.StatusOK, nil
 }
 
 // ------------------- Handlers -------------------
@@ -561,42 +1254,81 @@ func CreatePhotoFromFormData(s PhotoService, r *http.Request) (*Photo, int, erro
 // UploadPhoto Upload a new photo
 func UploadPhoto(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var photo *Photo
-		var err error
-		var status int
-
-		if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
-			photo, status, err = CreatePhotoFromFormData(s, r)
-		} else {
-			// photo, err, code = CreatePhotoFromJSON(r)
+		if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+			responses.BadRequest(w, r, "photos must be uploaded as multipart/form-data")
+			return
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		results, bulk, status, err := CreatePhotosFromFormData(s, r)
 		if err != nil {
 			responses.SwitchCase(w, r, status, err.Error())
 			return
 		}
-		log.Println("photo", photo.ID, "created successfully")
-		responses.StructCreated(w, r, &photo)
+		if bulk {
+			log.Println(len(results), "files processed in bulk upload")
+			responses.StructOK(w, r, results)
+			return
+		}
+
+		result := results[0]
+		if len(result.DuplicateOf) > 0 {
+			responses.ConflictProblem(result.err.Error()).
+				WithExtension("duplicates", result.DuplicateOf).SendProblem(w, r)
+			return
+		}
+		if result.err != nil {
+			responses.SwitchCase(w, r, result.Status, result.err.Error())
+			return
+		}
+		log.Println("photo", result.ID, "created successfully")
+		responses.StructCreated(w, r, result.photo)
 	}
 }
 
-// GetPhoto Get a photo
+// GetPhoto Get a photo by ID or by hash
 func GetPhoto(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Query().Get("id")
-		if id == "" {
-			responses.BadRequest(w, r, "no ID in the query")
+		var photo *Photo
+		var status int
+		var err error
+		if id := r.URL.Query().Get("id"); id != "" {
+			photo, status, err = s.GetPhotoById(id)
+		} else if hash := r.URL.Query().Get("hash"); hash != "" {
+			photo, status, err = s.GetPhotoByHash(hash)
+		} else {
+			responses.BadRequest(w, r, "no ID or hash in the query")
 			return
 		}
-		photo, status, err := s.GetPhotoById(id)
 		if err != nil {
 			responses.SwitchCase(w, r, status, err.Error())
 			return
 		}
 		log.Println("photo", photo.ID, "found")
+		w.Header().Set("ETag", photo.ETag())
 		responses.StructOK(w, r, photo)
 	}
 }
 
+// HasPhoto Check whether a file has already been uploaded, without sending it.
+// Responds 200 with the photo's location if it has, or 404 if it hasn't.
+func HasPhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash := r.URL.Query().Get("hash")
+		if hash == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		photo, status, err := s.GetPhotoByHash(hash)
+		if err != nil {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Location", "/api/v1/photo-dump/photo?id="+photo.ID)
+		w.Header().Set("X-Photo-Id", photo.ID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 // UpdatePhoto Update a photo
 func UpdatePhoto(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -607,7 +1339,7 @@ func UpdatePhoto(s PhotoService) http.HandlerFunc {
 			responses.BadRequest(w, r, "Could not decode photo")
 			return
 		}
-		status, err := s.EditPhoto(&photo)
+		status, err := s.EditPhoto(&photo, requestActor(r))
 		if err != nil {
 			responses.SwitchCase(w, r, status, err.Error())
 			return
@@ -617,7 +1349,7 @@ func UpdatePhoto(s PhotoService) http.HandlerFunc {
 	}
 }
 
-// DeletePhoto Delete a photo
+// DeletePhoto Move a photo to the trash
 func DeletePhoto(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
@@ -630,70 +1362,95 @@ func DeletePhoto(s PhotoService) http.HandlerFunc {
 			responses.BadRequest(w, r, "no confirm hash in the query")
 			return
 		}
-		status, err := s.SafeDeletePhoto(id, confirm)
+		status, err := s.SafeDeletePhoto(id, confirm, requestActor(r))
 		if err != nil {
 			responses.SwitchCase(w, r, status, err.Error())
 			return
 		}
-		log.Println("photo", id, "deleted successfully")
+		log.Println("photo", id, "moved to the trash successfully")
 		responses.NoContent(w)
 	}
 }
 
-// GetPhotos Get a list of photos
-func GetPhotos(s PhotoService, w http.ResponseWriter, r *http.Request) ([]*Photo, error) {
-	var amount int
-	var err error
-	strAmount := r.URL.Query().Get("amount")
-	if strAmount == "" {
-		amount = 12
-	} else {
-		amount, err = strconv.Atoi(strAmount)
-		if err != nil {
-			log.Println("invalid amount", err)
-			responses.BadRequest(w, r, "invalid amount")
-			return nil, err
-		}
-	}
-	var cursor int
-	strCursor := r.URL.Query().Get("cursor")
-	if strCursor == "" {
-		cursor = 1
-	} else {
-		cursor, err = strconv.Atoi(strCursor)
-		if err != nil {
-			log.Println("invalid cursor", err)
-			responses.BadRequest(w, r, "invalid cursor")
-			return nil, err
-		}
+// GetPhotos Get a page of photos matching the filters in the query, with links to the pages either side of it
+func GetPhotos(s PhotoService, w http.ResponseWriter, r *http.Request) (*PhotoPage, error) {
+	q, err := PhotoQueryFromValues(r.URL.Query())
+	if err != nil {
+		log.Println("invalid photo query", err)
+		responses.BadRequest(w, r, err.Error())
+		return nil, err
 	}
-
-	start := time.Date(2014, 0, 0, 0, 0, 0, 0, time.UTC)
-	photos, status, err := s.GetPhotosByDate(
-		start, time.Now(), amount, cursor)
+	page, status, err := s.SearchPhotos(q)
 	if err != nil {
 		responses.SwitchCase(w, r, status, err.Error())
 		return nil, err
 	}
-	return photos, nil
+	page.SetLinks(r)
+	page.SetLinkHeader(w)
+	return page, nil
 }
 
 func GetPhotosJSON(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		photos, err := GetPhotos(s, w, r)
+		page, err := GetPhotos(s, w, r)
 		if err != nil {
 			return
 		}
-		responses.StructOK(w, r, photos)
+		if WantsGeoJSON(r) {
+			responses.GeoJSON(w, r, NewFeatureCollection(page.Photos))
+			return
+		}
+		responses.StructOK(w, r, page)
+	}
+}
+
+func GetPhotosHTML(s PhotoService, cw web.FuncWrapper[*PhotoPage]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, err := GetPhotos(s, w, r)
+		if err != nil {
+			return
+		}
+		responses.SendComponent(w, r, cw(page))
 	}
 }
 
-func GetPhotosHTML(s PhotoService, cw web.FuncWrapper[[]*Photo]) http.HandlerFunc {
+// GetSimilarPhotos Get the photos that look like a stored photo, or an uploaded probe image
+func GetSimilarPhotos(s PhotoService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		photos, err := GetPhotos(s, w, r)
+		hd, err := QueryInt(r, "distance", DefaultLikeDistance)
 		if err != nil {
+			log.Println("invalid distance", err)
+			responses.BadRequest(w, r, "invalid distance")
 			return
 		}
-		responses.SendComponent(w, r, cw(photos))
+		amount, err := QueryInt(r, "amount", 12)
+		if err != nil || amount < 0 {
+			log.Println("invalid amount", err)
+			responses.BadRequest(w, r, "invalid amount")
+			return
+		}
+
+		var photos []*LikePhoto
+		var status int
+		if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+			var probe *Photo
+			r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+			probe, status, err = ProbePhotoFromFormData(r)
+			if err == nil {
+				photos, status, err = s.GetLikePhotos(probe.PHashes, hd, amount)
+			}
+		} else {
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				responses.BadRequest(w, r, "no ID in the query")
+				return
+			}
+			photos, status, err = s.GetSimilarPhotos(id, hd, amount)
+		}
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, photos)
 	}
 }
@@ -0,0 +1,322 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/database"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/minio/minio-go/v7"
+)
+
+// ------------------- Types -------------------
+
+// StoredObject An object in the photos bucket
+type StoredObject struct {
+	Key        string
+	ModifiedAt time.Time
+}
+
+// ReconcileReport What reconciling the photos bucket with the photos table found, and whether it was repaired
+type ReconcileReport struct {
+	Objects int `json:"objects"`
+	Photos  int `json:"photos"`
+	Pending int `json:"pending"`
+	// Recent Photos that were uploaded or changed too recently to check, they're left alone
+	Recent int `json:"recent"`
+	// OrphanObjects Objects that no photo refers to and that aren't waiting in the outbox
+	OrphanObjects []string `json:"orphan_objects"`
+	// MisplacedPhotos Photos whose original is in or out of the trash when it shouldn't be
+	MisplacedPhotos []string `json:"misplaced_photos"`
+	// MissingPhotos Photos whose original is nowhere to be found
+	MissingPhotos []string `json:"missing_photos"`
+	// MissingDerivatives Photos with derivatives or a rendition that have gone missing
+	MissingDerivatives []string `json:"missing_derivatives"`
+	Repaired           bool     `json:"repaired"`
+}
+
+// -------------- Globals --------------
+
+// ReconcileMinAge Objects and photos younger than this are left alone,
+// as they may belong to an upload or job that's still going, or one that finished after the bucket was listed
+const ReconcileMinAge = time.Hour
+
+// ReconcileMaxMissing The largest share of photos that can be missing their original for a repair to go ahead.
+// Any more is more likely to be a bad listing of the bucket than lost files, so nothing is repaired.
+const ReconcileMaxMissing = 0.1
+
+// ------------------- Store -------------------
+
+// ListObjectsInS3 List every object in the photos bucket
+func (s *store) ListObjectsInS3() ([]StoredObject, error) {
+	objects := make([]StoredObject, 0)
+	for info := range s.s3.ListObjects(context.Background(), "photos", minio.ListObjectsOptions{Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, StoredObject{Key: info.Key, ModifiedAt: info.LastModified})
+	}
+	return objects, nil
+}
+
+// ObjectExistsInS3 Whether an object is in the photos bucket
+func (s *store) ObjectExistsInS3(object string) (bool, error) {
+	_, err := s.s3.StatObject(context.Background(), "photos", object, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetAllPhotos Get every photo, including the ones in the trash
+func (s *store) GetAllPhotos() ([]*Photo, error) {
+	rows, err := s.db.Query(context.Background(), "SELECT "+photoColumns+" FROM photos ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+// ------------------- Service -------------------
+
+// Reconcile Compare the photos bucket with the photos table, and repair what it finds if asked to.
+// Orphan objects are queued for deletion, misplaced originals are moved back to where their row expects them,
+// photos without an original are moved to the trash, and missing derivatives and renditions are generated again.
+func (s *service) Reconcile(repair bool) (*ReconcileReport, int, error) {
+	// Listing the bucket first means objects stored while the table is read show up as referenced rather than orphans.
+	// Rows stored after the listing would look like they're missing their original, so recent rows are skipped,
+	// and every photo is checked again before it's repaired.
+	start := time.Now()
+	objects, err := s.ps.ListObjectsInS3()
+	if err != nil {
+		log.Println("could not list photos in S3", err)
+		return nil, http.StatusInternalServerError, errors.New("could not list photos in S3")
+	}
+	photos, err := s.ps.GetAllPhotos()
+	if err != nil {
+		log.Println("could not get photos", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photos")
+	}
+	pending, err := s.ps.GetOutboxObjects()
+	if err != nil {
+		log.Println("could not get the outbox", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get the outbox")
+	}
+
+	report := &ReconcileReport{
+		Objects:            len(objects),
+		Photos:             len(photos),
+		Pending:            len(pending),
+		OrphanObjects:      make([]string, 0),
+		MisplacedPhotos:    make([]string, 0),
+		MissingPhotos:      make([]string, 0),
+		MissingDerivatives: make([]string, 0),
+		Repaired:           repair,
+	}
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+	}
+	referenced := make(map[string]bool, len(photos))
+	for _, object := range pending {
+		referenced[object] = true
+	}
+
+	for _, photo := range photos {
+		refs := photoObjects(photo)
+		for _, object := range refs {
+			referenced[object] = true
+		}
+		original, other := photoLocations(photo)
+		if photo.ChangedSince(start.Add(-ReconcileMinAge)) {
+			// It may be moving in or out of the trash, so neither place is an orphan
+			referenced[other] = true
+			report.Recent++
+			continue
+		}
+		switch {
+		case stored[original]:
+			for _, object := range refs[1:] {
+				if !stored[object] {
+					report.MissingDerivatives = append(report.MissingDerivatives, photo.ID)
+					break
+				}
+			}
+		case stored[other]:
+			report.MisplacedPhotos = append(report.MisplacedPhotos, photo.ID)
+			// The original is where it is, so it mustn't be reported as an orphan
+			referenced[other] = true
+		default:
+			report.MissingPhotos = append(report.MissingPhotos, photo.ID)
+		}
+	}
+	for _, object := range objects {
+		if !referenced[object.Key] && time.Since(object.ModifiedAt) > ReconcileMinAge {
+			report.OrphanObjects = append(report.OrphanObjects, object.Key)
+		}
+	}
+	log.Println("reconciled photos. Objects: " + strconv.Itoa(report.Objects) + " Photos: " + strconv.Itoa(report.Photos) +
+		" Recent: " + strconv.Itoa(report.Recent) +
+		" Orphans: " + strconv.Itoa(len(report.OrphanObjects)) + " Misplaced: " + strconv.Itoa(len(report.MisplacedPhotos)) +
+		" Missing: " + strconv.Itoa(len(report.MissingPhotos)) + " Missing derivatives: " + strconv.Itoa(len(report.MissingDerivatives)))
+	if !repair {
+		return report, http.StatusOK, nil
+	}
+	checked := report.Photos - report.Recent
+	if checked > 0 && (report.Objects == 0 || float64(len(report.MissingPhotos)) > ReconcileMaxMissing*float64(checked)) {
+		log.Println("refusing to repair photos, too many are missing their original. Missing: " +
+			strconv.Itoa(len(report.MissingPhotos)) + " Checked: " + strconv.Itoa(checked))
+		return nil, http.StatusConflict, errors.New("refusing to repair, " + strconv.Itoa(len(report.MissingPhotos)) + " of " +
+			strconv.Itoa(checked) + " photos are missing their original, which looks more like a bad listing of the bucket")
+	}
+
+	status, err := s.repairPhotos(photos, report)
+	if err != nil {
+		return nil, status, err
+	}
+	// Work through the deletions now, as the server may not be running to do it
+	for s.runOutbox() {
+	}
+	return report, http.StatusOK, nil
+}
+
+// repairPhotos Fix what Reconcile found
+func (s *service) repairPhotos(photos []*Photo, report *ReconcileReport) (int, error) {
+	if len(report.OrphanObjects) > 0 {
+		err := s.ps.QueueObjectDeletions("", report.OrphanObjects, time.Now())
+		// Orphans that are already being deleted don't need queueing
+		if err != nil && !errors.Is(err, errDeletionClaimed) {
+			log.Println("could not queue orphan objects for deletion", err)
+			return http.StatusInternalServerError, errors.New("could not queue orphan objects for deletion")
+		}
+	}
+	byID := make(map[string]*Photo, len(photos))
+	for _, photo := range photos {
+		byID[photo.ID] = photo
+	}
+
+	for _, id := range report.MisplacedPhotos {
+		photo, inPlace, elsewhere, status, err := s.recheckPhoto(byID[id])
+		if err != nil {
+			return status, err
+		}
+		if photo == nil || inPlace || !elsewhere {
+			log.Println("misplaced photo has changed since the bucket was listed, leaving it. ID: " + id)
+			continue
+		}
+		to, from := photoLocations(photo)
+		status, err = s.movePhotoInS3(photo, from, to)
+		if err != nil {
+			return status, err
+		}
+		err = s.ps.UpdatePhotoTrash(photo, []string{from})
+		if err != nil {
+			log.Println("could not update moved photo. ID: "+photo.ID, err)
+			return http.StatusInternalServerError, errors.New("could not update moved photo")
+		}
+		log.Println("moved misplaced photo. ID: " + photo.ID)
+	}
+
+	// Photos without an original are moved to the trash rather than deleted, so they can be restored if it turns up
+	for _, id := range report.MissingPhotos {
+		photo, inPlace, elsewhere, status, err := s.recheckPhoto(byID[id])
+		if err != nil {
+			return status, err
+		}
+		if photo == nil || inPlace || elsewhere {
+			log.Println("missing photo has changed since the bucket was listed, leaving it. ID: " + id)
+			continue
+		}
+		if photo.DeletedAt != nil {
+			log.Println("missing photo is already in the trash. ID: " + id)
+			continue
+		}
+		old := *photo
+		now := time.Now()
+		photo.DeletedAt = &now
+		photo.File = database.S3_FILE_URI + "/photos/" + TrashPrefix + photoObject(photo)
+		photo.Derivatives = make([]Derivative, 0)
+		photo.Rendition = ""
+		err = s.ps.UpdatePhotoTrash(photo, photoObjects(&old))
+		if err != nil {
+			log.Println("could not move missing photo to the trash. ID: "+id, err)
+			return http.StatusInternalServerError, errors.New("could not move missing photo to the trash")
+		}
+		s.recordHistory(id, HistoryDelete, "reconcile", nil)
+		log.Println("moved photo with a missing original to the trash. ID: " + id)
+	}
+
+	for _, id := range report.MissingDerivatives {
+		photo := byID[id]
+		kinds := []JobKind{DerivativesJob}
+		if photo.Rendition != "" {
+			kinds = append(kinds, RenditionJob)
+		}
+		for _, kind := range kinds {
+			_, status, err := s.QueuePhotoJob(id, kind)
+			if err != nil {
+				return status, err
+			}
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// recheckPhoto Get a photo again and look for its original, to make sure it still needs repairing.
+// Returns a nil photo if it's been purged or changed since it was listed,
+// and whether the original is where the row expects it and whether it's in the other place.
+func (s *service) recheckPhoto(listed *Photo) (*Photo, bool, bool, int, error) {
+	photo, err := s.ps.GetPhotoById(listed.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, false, http.StatusOK, nil
+	}
+	if err != nil {
+		log.Println("could not get photo. ID: "+listed.ID, err)
+		return nil, false, false, http.StatusInternalServerError, errors.New("could not get photo")
+	}
+	if photo.File != listed.File || !photo.ModifiedAt.Equal(listed.ModifiedAt) || (photo.DeletedAt == nil) != (listed.DeletedAt == nil) {
+		return nil, false, false, http.StatusOK, nil
+	}
+	original, other := photoLocations(photo)
+	inPlace, err := s.ps.ObjectExistsInS3(original)
+	if err != nil {
+		log.Println("could not check photo in S3. ID: "+photo.ID, err)
+		return nil, false, false, http.StatusInternalServerError, errors.New("could not check photo in S3")
+	}
+	elsewhere, err := s.ps.ObjectExistsInS3(other)
+	if err != nil {
+		log.Println("could not check photo in S3. ID: "+photo.ID, err)
+		return nil, false, false, http.StatusInternalServerError, errors.New("could not check photo in S3")
+	}
+	return photo, inPlace, elsewhere, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// photoLocations Where the original of a photo should be according to its row, and where it would be otherwise,
+// ie. in or out of the trash
+func photoLocations(p *Photo) (string, string) {
+	if p.DeletedAt != nil {
+		return TrashPrefix + photoObject(p), photoObject(p)
+	}
+	return photoObject(p), TrashPrefix + photoObject(p)
+}
+
+// ChangedSince Whether the photo was uploaded, edited or trashed after a time
+func (p *Photo) ChangedSince(t time.Time) bool {
+	return p.UploadedAt.After(t) || p.ModifiedAt.After(t) || (p.DeletedAt != nil && p.DeletedAt.After(t))
+}
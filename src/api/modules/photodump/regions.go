@@ -0,0 +1,270 @@
+package photodump
+
+import (
+	"errors"
+	"fmt"
+	"home_api/src/responses"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/kolesa-team/goexiv"
+)
+
+// ------------------- Types -------------------
+
+// RegionSource Where a Region came from
+type RegionSource string
+
+const (
+	MWGRegion       RegionSource = "mwg-rs"
+	MicrosoftRegion RegionSource = "microsoft"
+	ManualRegion    RegionSource = "manual"
+)
+
+// Region A labelled rectangle on a photo, eg. someone's face.
+// The coordinates are normalized to 0-1 and measured from the top left of the upright image.
+type Region struct {
+	X        float64      `json:"x"`
+	Y        float64      `json:"y"`
+	Width    float64      `json:"width"`
+	Height   float64      `json:"height"`
+	Name     string       `json:"name"`
+	PersonID *int64       `json:"person_id,omitempty"`
+	Type     string       `json:"type"`
+	Source   RegionSource `json:"source"`
+}
+
+// -------------- Globals --------------
+
+// MaxRegions The most regions a photo can have, and the most read from a file's metadata
+const MaxRegions = 100
+
+const mwgRegionKey = "Xmp.mwg-rs.Regions/mwg-rs:RegionList[%d]/"
+const microsoftRegionKey = "Xmp.MP.RegionInfo/MPRI:Regions[%d]/"
+
+// ------------------- Service -------------------
+
+// SetPhotoRegions Replace the regions of a photo, linking them to the people they name.
+// It's saved like any other edit, so it changes the ETag and is recorded in the history.
+func (s *service) SetPhotoRegions(id string, regions []Region, actor string) (*Photo, int, error) {
+	photo, status, err := s.GetPhotoById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	if len(regions) > MaxRegions {
+		return nil, http.StatusBadRequest, errors.New("too many regions, the most is " + strconv.Itoa(MaxRegions))
+	}
+	for i := range regions {
+		err = regions[i].normalize()
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("region " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	status, err = s.savePatch(photo, &PhotoPatch{Regions: &regions}, actor, HistoryEdit)
+	if err != nil {
+		return nil, status, err
+	}
+	return photo, http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// normalize Tidy up a region sent by a client, and check that it fits on the photo
+func (r *Region) normalize() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Type = strings.ToLower(strings.TrimSpace(r.Type))
+	if r.Type == "" {
+		r.Type = "face"
+	}
+	switch r.Source {
+	case "":
+		r.Source = ManualRegion
+	case ManualRegion, MWGRegion, MicrosoftRegion:
+	default:
+		return errors.New("unknown region source: " + string(r.Source))
+	}
+	for _, v := range []float64{r.X, r.Y, r.Width, r.Height} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("coordinates must be numbers")
+		}
+	}
+	// A little leeway for rounding in the client
+	const epsilon = 1e-6
+	if r.X < 0 || r.Y < 0 || r.Width <= 0 || r.Height <= 0 ||
+		r.X+r.Width > 1+epsilon || r.Y+r.Height > 1+epsilon {
+		return errors.New("coordinates must be normalized to the photo")
+	}
+	return nil
+}
+
+// xmpRegions Read the face regions from the XMP metadata, turning them upright with the orientation.
+// MWG regions are preferred, the Microsoft Photo ones are only used if there aren't any,
+// as Windows writes both for the same faces.
+func xmpRegions(data *goexiv.XmpData, o Orientation) []Region {
+	regions := mwgRegions(data)
+	if len(regions) == 0 {
+		regions = microsoftRegions(data)
+	}
+	for i := range regions {
+		regions[i].orient(o)
+	}
+	return regions
+}
+
+// mwgRegions Read the MWG regions, their areas are measured from the centre of the rectangle
+func mwgRegions(data *goexiv.XmpData) []Region {
+	regions := make([]Region, 0)
+	for i := 1; i <= MaxRegions; i++ {
+		prefix := fmt.Sprintf(mwgRegionKey, i)
+		area := make([]float64, 0, 4)
+		for _, field := range []string{"x", "y", "w", "h"} {
+			v, err := strconv.ParseFloat(xmpValue(data, prefix+"mwg-rs:Area/stArea:"+field), 64)
+			if err != nil {
+				break
+			}
+			area = append(area, v)
+		}
+		if len(area) < 4 {
+			// The list has ended, unless just the area is missing
+			if xmpValue(data, prefix+"mwg-rs:Name") == "" && xmpValue(data, prefix+"mwg-rs:Type") == "" {
+				break
+			}
+			continue
+		}
+		unit := xmpValue(data, prefix+"mwg-rs:Area/stArea:unit")
+		if unit != "" && unit != "normalized" {
+			continue
+		}
+		region := Region{
+			X:      area[0] - area[2]/2,
+			Y:      area[1] - area[3]/2,
+			Width:  area[2],
+			Height: area[3],
+			Name:   strings.TrimSpace(xmpValue(data, prefix+"mwg-rs:Name")),
+			Type:   strings.ToLower(xmpValue(data, prefix+"mwg-rs:Type")),
+			Source: MWGRegion,
+		}
+		if region.Type == "" {
+			region.Type = "face"
+		}
+		if region.clamp() {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// microsoftRegions Read the Microsoft Photo regions, their rectangles are "x, y, w, h" from the top left
+func microsoftRegions(data *goexiv.XmpData) []Region {
+	regions := make([]Region, 0)
+	for i := 1; i <= MaxRegions; i++ {
+		prefix := fmt.Sprintf(microsoftRegionKey, i)
+		rect := xmpValue(data, prefix+"MPReg:Rectangle")
+		name := strings.TrimSpace(xmpValue(data, prefix+"MPReg:PersonDisplayName"))
+		if rect == "" && name == "" {
+			break
+		}
+		fields := strings.Split(rect, ",")
+		if len(fields) != 4 {
+			continue
+		}
+		area := make([]float64, 0, 4)
+		for _, field := range fields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil {
+				break
+			}
+			area = append(area, v)
+		}
+		if len(area) < 4 {
+			continue
+		}
+		region := Region{X: area[0], Y: area[1], Width: area[2], Height: area[3],
+			Name: name, Type: "face", Source: MicrosoftRegion}
+		if region.clamp() {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// xmpValue Get a single XMP value, or an empty string if it isn't set
+func xmpValue(data *goexiv.XmpData, key string) string {
+	datum, err := data.FindKey(key)
+	if err != nil || datum == nil {
+		return ""
+	}
+	return strings.TrimSpace(datum.String())
+}
+
+// clamp Trim a region to the photo, returns false if nothing is left of it
+func (r *Region) clamp() bool {
+	left, top := max(r.X, 0), max(r.Y, 0)
+	right, bottom := min(r.X+r.Width, 1), min(r.Y+r.Height, 1)
+	if right <= left || bottom <= top {
+		return false
+	}
+	r.X, r.Y, r.Width, r.Height = left, top, right-left, bottom-top
+	return true
+}
+
+// orient Move a region measured on the image as it's stored onto the upright image
+func (r *Region) orient(o Orientation) {
+	x1, y1 := o.point(r.X, r.Y)
+	x2, y2 := o.point(r.X+r.Width, r.Y+r.Height)
+	r.X, r.Y = min(x1, x2), min(y1, y2)
+	r.Width, r.Height = math.Abs(x2-x1), math.Abs(y2-y1)
+}
+
+// point Where a normalized point on the stored image ends up on the upright image
+func (o Orientation) point(x, y float64) (float64, float64) {
+	switch o {
+	case FlipHorizontal:
+		return 1 - x, y
+	case Rotate180:
+		return 1 - x, 1 - y
+	case FlipVertical:
+		return x, 1 - y
+	case Transpose:
+		return y, x
+	case Rotate90:
+		return 1 - y, x
+	case Transverse:
+		return 1 - y, 1 - x
+	case Rotate270:
+		return y, 1 - x
+	default:
+		return x, y
+	}
+}
+
+// ------------------- Handlers -------------------
+
+// SetPhotoRegions Replace the regions of the photo in the query with the JSON list in the body
+func SetPhotoRegions(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			responses.BadRequest(w, r, "no ID in the query")
+			return
+		}
+		regions := make([]Region, 0)
+		err := json.NewDecoder(r.Body).Decode(&regions)
+		if err != nil {
+			log.Println("Could not decode regions", err)
+			responses.BadRequest(w, r, "Could not decode regions")
+			return
+		}
+		photo, status, err := s.SetPhotoRegions(id, regions, requestActor(r))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		w.Header().Set("ETag", photo.ETag())
+		responses.StructOK(w, r, photo.Regions)
+	}
+}
@@ -0,0 +1,425 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// PhotoSort The order a list of photos is sorted in
+type PhotoSort string
+
+const (
+	// SortTakenDesc Newest photos first, by when they were taken
+	SortTakenDesc PhotoSort = "taken_at_desc"
+	// SortTakenAsc Oldest photos first, by when they were taken
+	SortTakenAsc PhotoSort = "taken_at_asc"
+	// SortUploadedDesc Most recently uploaded photos first
+	SortUploadedDesc PhotoSort = "uploaded_at_desc"
+	// SortUploadedAsc Least recently uploaded photos first
+	SortUploadedAsc PhotoSort = "uploaded_at_asc"
+	// SortRelevance Best matches for the search text first
+	SortRelevance PhotoSort = "relevance"
+)
+
+// Valid Whether the sort is one of the known sorts
+func (s PhotoSort) Valid() bool {
+	switch s {
+	case SortTakenDesc, SortTakenAsc, SortUploadedDesc, SortUploadedAsc, SortRelevance:
+		return true
+	}
+	return false
+}
+
+// Column The column the photos are sorted by
+func (s PhotoSort) Column() string {
+	switch s {
+	case SortUploadedDesc, SortUploadedAsc:
+		return "uploaded_at"
+	case SortRelevance:
+		return "rank"
+	}
+	return "taken_at"
+}
+
+// Descending Whether the largest values come first
+func (s PhotoSort) Descending() bool {
+	return s == SortTakenDesc || s == SortUploadedDesc || s == SortRelevance
+}
+
+// Key The value a photo is sorted by
+func (s PhotoSort) Key(p *Photo) time.Time {
+	switch s {
+	case SortUploadedDesc, SortUploadedAsc:
+		return p.UploadedAt
+	}
+	return p.TakenAt
+}
+
+// PhotoQuery The filters, order and page of a photo search. Empty filters match everything,
+// lists of tags and subjects must all match, and any of the extensions can match.
+// The filters and order are saved as JSON by smart albums, the page never is.
+type PhotoQuery struct {
+	From       *time.Time   `json:"from,omitempty"`
+	To         *time.Time   `json:"to,omitempty"`
+	EveryYear  *AnnualDates `json:"every_year,omitempty"`
+	Tags       []string     `json:"tags,omitempty"`
+	Subjects   []string     `json:"subjects,omitempty"`
+	People     []int64      `json:"people,omitempty"`
+	Source     string       `json:"source,omitempty"`
+	Resolution string       `json:"resolution,omitempty"`
+	Exts       []string     `json:"ext,omitempty"`
+	Camera     Camera       `json:"camera"`
+	Near       *Circle      `json:"near,omitempty"`
+	Box        *BoundingBox `json:"bbox,omitempty"`
+	Text       string       `json:"q,omitempty"`
+	Sort       PhotoSort    `json:"sort,omitempty"`
+	Amount     int          `json:"-"`
+	Cursor     *Cursor      `json:"-"`
+}
+
+// AnnualDates A range of days that recurs every year, like "12-24" to "12-26" for Christmas.
+// Both days are "MM-DD" and inclusive, and the range wraps around the new year when From is after To.
+type AnnualDates struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// FoundPhoto A Photo from a search, along with how well it matches the search text
+// and a snippet of it as HTML, escaped, with the matches in <mark> tags
+type FoundPhoto struct {
+	Photo
+	Rank    float32 `json:"rank,omitempty" db:"rank"`
+	Snippet string  `json:"snippet,omitempty" db:"snippet"`
+}
+
+// -------------- Globals --------------
+
+// snippetStart and snippetStop Private use characters ts_headline marks the matches in search snippets with.
+// They're swapped for <mark> tags once the rest of the snippet is escaped, and removed from the text beforehand.
+const (
+	snippetStart = "\ue000"
+	snippetStop  = "\ue001"
+)
+
+// SnippetOptions How ts_headline highlights the matches in search snippets
+const SnippetOptions = "StartSel=" + snippetStart + ", StopSel=" + snippetStop + ", MaxFragments=2, MaxWords=20, MinWords=5"
+
+// ------------------- Store -------------------
+
+// SQL Build the query for a photo search, fetching up to limit photos
+func (q *PhotoQuery) SQL(limit int) (string, []any) {
+	// Photos in the trash are hidden until they're restored
+	conditions := []string{"deleted_at IS NULL"}
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	column := q.Sort.Column()
+	rank, snippet := "0::REAL", "''"
+	if q.Text != "" {
+		query := "websearch_to_tsquery('english', " + arg(q.Text) + ")"
+		conditions = append(conditions, "search @@ "+query)
+		rank = "ts_rank(search, " + query + ")"
+		text := "concat_ws(' ', description, source, array_to_string(subjects, ' '), array_to_string(tags, ' '))"
+		snippet = "ts_headline('english', translate(" + text + ", " + arg(snippetStart+snippetStop) + "::TEXT, ''), " +
+			query + ", " + arg(SnippetOptions) + "::TEXT)"
+	}
+	if q.Sort == SortRelevance {
+		// The alias can't be used in the WHERE clause
+		column = rank
+	} else {
+		conditions = append(conditions, column+" IS NOT NULL")
+	}
+	if q.From != nil {
+		conditions = append(conditions, "taken_at >= "+arg(*q.From))
+	}
+	if q.To != nil {
+		conditions = append(conditions, "taken_at < "+arg(*q.To))
+	}
+	if len(q.Tags) > 0 {
+		conditions = append(conditions, "tags @> "+arg(q.Tags)+"::TEXT[]")
+	}
+	if len(q.Subjects) > 0 {
+		conditions = append(conditions, "subjects @> "+arg(q.Subjects)+"::TEXT[]")
+	}
+	if len(q.People) > 0 {
+		conditions = append(conditions, "people @> "+arg(q.People)+"::BIGINT[]")
+	}
+	if q.Source != "" {
+		conditions = append(conditions, "source = "+arg(q.Source))
+	}
+	if q.Resolution != "" {
+		conditions = append(conditions, "resolution = "+arg(q.Resolution))
+	}
+	if len(q.Exts) > 0 {
+		conditions = append(conditions, "ext = ANY("+arg(q.Exts)+"::TEXT[])")
+	}
+	if q.Camera.Make != "" {
+		conditions = append(conditions, "camera_make = "+arg(q.Camera.Make))
+	}
+	if q.Camera.Model != "" {
+		conditions = append(conditions, "camera_model = "+arg(q.Camera.Model))
+	}
+	if q.EveryYear != nil {
+		// The day in the zone the photo was taken in, rather than in UTC
+		day := "to_char(CASE WHEN taken_at_offset IS NULL THEN taken_at AT TIME ZONE " + arg(defaultTimezone.String()) + "::TEXT" +
+			" ELSE (taken_at AT TIME ZONE 'UTC') + taken_at_offset * INTERVAL '1 second' END, 'MM-DD')"
+		from, to := arg(q.EveryYear.From)+"::TEXT", arg(q.EveryYear.To)+"::TEXT"
+		if q.EveryYear.From <= q.EveryYear.To {
+			conditions = append(conditions, day+" BETWEEN "+from+" AND "+to)
+		} else {
+			conditions = append(conditions, "("+day+" >= "+from+" OR "+day+" <= "+to+")")
+		}
+	}
+	if q.Near != nil {
+		lat, lon := arg(q.Near.Lat)+"::DOUBLE PRECISION", arg(q.Near.Lon)+"::DOUBLE PRECISION"
+		band := arg(q.Near.RadiusKm/KmPerDegree) + "::DOUBLE PRECISION"
+		conditions = append(conditions,
+			"latitude BETWEEN "+lat+" - "+band+" AND "+lat+" + "+band,
+			distanceKmSQL(lat, lon)+" <= "+arg(q.Near.RadiusKm)+"::DOUBLE PRECISION")
+	}
+	if q.Box != nil {
+		conditions = append(conditions, "("+inBoxSQL(arg(q.Box.West), arg(q.Box.South), arg(q.Box.East), arg(q.Box.North))+")")
+	}
+
+	// Backward pages are fetched in the opposite order, then reversed
+	descending := q.Sort.Descending()
+	if q.Cursor != nil && q.Cursor.Backward {
+		descending = !descending
+	}
+	direction, comparison := "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+	if q.Cursor != nil {
+		key := arg(q.Cursor.Time)
+		if q.Sort == SortRelevance {
+			key = arg(q.Cursor.Rank) + "::REAL"
+		}
+		conditions = append(conditions,
+			"("+column+", id) "+comparison+" ("+key+", "+arg(q.Cursor.ID)+"::TEXT)")
+	}
+
+	sql := "SELECT " + photoColumns + ", " + rank + " AS rank, " + snippet + " AS snippet FROM photos" +
+		"\nWHERE " + strings.Join(conditions, "\nAND ") +
+		"\nORDER BY " + column + " " + direction + ", id " + direction +
+		"\nLIMIT " + arg(limit)
+	return sql, args
+}
+
+// SearchPhotos Get up to limit photos matching a query
+func (s *store) SearchPhotos(q *PhotoQuery, limit int) ([]*FoundPhoto, error) {
+	sql, args := q.SQL(limit)
+	rows, err := s.db.Query(context.Background(), sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[FoundPhoto])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+		photo.Snippet = highlightSnippet(photo.Snippet)
+	}
+	return photos, nil
+}
+
+// ------------------- Service -------------------
+
+// SearchPhotos Get a page of the photos matching a query
+func (s *service) SearchPhotos(q *PhotoQuery) (*PhotoPage, int, error) {
+	if q.Amount < 1 || q.Amount > MaxPageAmount {
+		return nil, http.StatusBadRequest, errors.New("amount must be between 1 and " + strconv.Itoa(MaxPageAmount))
+	}
+	err := q.Validate()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	// Photos are tagged with the names in the vocabulary, so aliases are followed.
+	// Unknown tags are kept, they just don't match anything.
+	if len(q.Tags) > 0 {
+		var status int
+		q.Tags, _, status, err = s.ts.ResolveTags(q.Tags)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	// Fetch one extra photo to find out whether there's another page
+	photos, err := s.ps.SearchPhotos(q, q.Amount+1)
+	if err != nil {
+		log.Println("could not search photos", err)
+		return nil, http.StatusInternalServerError, errors.New("could not search photos")
+	}
+	return NewPhotoPage(photos, q.Amount, q.Sort, q.Cursor), http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// Validate Check the filters and sort of a photo search
+func (q *PhotoQuery) Validate() error {
+	if !q.Sort.Valid() {
+		return errors.New("invalid sort: " + string(q.Sort))
+	}
+	if q.Sort == SortRelevance && q.Text == "" {
+		return errors.New("sorting by relevance needs search text in q")
+	}
+	if q.EveryYear != nil {
+		for _, day := range []string{q.EveryYear.From, q.EveryYear.To} {
+			if _, err := time.Parse("01-02", day); err != nil {
+				return errors.New("every_year days must be MM-DD: " + day)
+			}
+		}
+	}
+	if q.Near != nil {
+		if err := q.Near.Validate(); err != nil {
+			return err
+		}
+	}
+	if q.Box != nil {
+		if err := q.Box.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PhotoQueryFromValues Read a photo search from query parameters
+func PhotoQueryFromValues(values url.Values) (*PhotoQuery, error) {
+	q := &PhotoQuery{
+		Tags:       splitList(values.Get("tags")),
+		Subjects:   splitList(values.Get("subjects")),
+		Source:     values.Get("source"),
+		Resolution: values.Get("resolution"),
+		Exts:       splitList(values.Get("ext")),
+		Camera: Camera{
+			Make:  values.Get("camera_make"),
+			Model: values.Get("camera_model"),
+		},
+		Text: strings.TrimSpace(values.Get("q")),
+		Sort: SortTakenDesc,
+	}
+	var err error
+	q.People, err = splitIDs(values.Get("people"))
+	if err != nil {
+		return nil, errors.New("invalid people, " + err.Error())
+	}
+	if from := values.Get("from"); from != "" {
+		t, err := ParseTime(from)
+		if err != nil {
+			return nil, errors.New("invalid from, " + err.Error())
+		}
+		q.From = &t
+	}
+	if to := values.Get("to"); to != "" {
+		t, err := ParseTime(to)
+		if err != nil {
+			return nil, errors.New("invalid to, " + err.Error())
+		}
+		q.To = &t
+	}
+	if days := splitList(values.Get("every_year")); len(days) > 0 {
+		if len(days) != 2 {
+			return nil, errors.New("every_year must be from,to")
+		}
+		q.EveryYear = &AnnualDates{From: days[0], To: days[1]}
+	}
+	if values.Has("lat") || values.Has("lon") || values.Has("radius_km") {
+		var floats [3]float64
+		for i, key := range []string{"lat", "lon", "radius_km"} {
+			f, err := strconv.ParseFloat(values.Get(key), 64)
+			if err != nil {
+				return nil, errors.New("lat, lon and radius_km must all be numbers")
+			}
+			floats[i] = f
+		}
+		q.Near = &Circle{Lat: floats[0], Lon: floats[1], RadiusKm: floats[2]}
+	}
+	if bbox := values.Get("bbox"); bbox != "" {
+		box, err := ParseBoundingBox(bbox)
+		if err != nil {
+			return nil, err
+		}
+		q.Box = &box
+	}
+	if q.Text != "" {
+		q.Sort = SortRelevance
+	}
+	err = q.SetPage(values)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetPage Read the sort, amount and cursor of a photo search from query parameters,
+// keeping the search's own sort if none is given
+func (q *PhotoQuery) SetPage(values url.Values) error {
+	if sort := values.Get("sort"); sort != "" {
+		q.Sort = PhotoSort(sort)
+		if !q.Sort.Valid() {
+			return errors.New("invalid sort: " + sort)
+		}
+	}
+	q.Amount = DefaultPageAmount
+	if amount := values.Get("amount"); amount != "" {
+		var err error
+		q.Amount, err = strconv.Atoi(amount)
+		if err != nil {
+			return errors.New("invalid amount")
+		}
+	}
+	var err error
+	q.Cursor, err = ParseCursor(values.Get("cursor"), q.Sort)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// highlightSnippet Escape a snippet from ts_headline as HTML, then wrap its matches in <mark> tags
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, snippetStart, "<mark>")
+	return strings.ReplaceAll(snippet, snippetStop, "</mark>")
+}
+
+// splitIDs Split a comma separated list of family tree person IDs
+func splitIDs(str string) ([]int64, error) {
+	var ids []int64
+	for _, item := range splitList(str) {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, errors.New("expected a person ID: " + item)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// splitList Split a comma separated list, dropping empty items
+func splitList(str string) []string {
+	var items []string
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,291 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/database"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+)
+
+// ------------------- Types -------------------
+
+// SmartAlbum An album defined by a saved photo search, so the photos in it are always up to date
+type SmartAlbum struct {
+	ID          string     `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description" db:"description"`
+	Query       PhotoQuery `json:"query" db:"query"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	ModifiedAt  time.Time  `json:"modified_at" db:"modified_at"`
+}
+
+// ------------------- Store -------------------
+
+// GetSmartAlbums Get every smart album, by name
+func (s *store) GetSmartAlbums() ([]*SmartAlbum, error) {
+	rows, err := s.db.Query(context.Background(), "SELECT * FROM smart_albums ORDER BY name, created_at")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[SmartAlbum])
+}
+
+// GetSmartAlbumById Get the specified SmartAlbum from the database
+func (s *store) GetSmartAlbumById(id string) (*SmartAlbum, error) {
+	rows, _ := s.db.Query(context.Background(), "SELECT * FROM smart_albums WHERE id = $1", id)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[SmartAlbum])
+}
+
+// CreateSmartAlbum Add a SmartAlbum to the database
+func (s *store) CreateSmartAlbum(a *SmartAlbum) error {
+	_, err := s.db.Exec(context.Background(), `
+INSERT INTO smart_albums (id, name, description, query, created_at, modified_at)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+		a.ID, a.Name, a.Description, a.Query, a.CreatedAt, a.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateSmartAlbum Update the name, description and query of a SmartAlbum in the database
+func (s *store) UpdateSmartAlbum(a *SmartAlbum) error {
+	_, err := s.db.Exec(context.Background(),
+		"UPDATE smart_albums SET name = $2, description = $3, query = $4, modified_at = $5 WHERE id = $1",
+		a.ID, a.Name, a.Description, a.Query, a.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteSmartAlbum Delete a SmartAlbum from the database
+func (s *store) DeleteSmartAlbum(id string) error {
+	_, err := s.db.Exec(context.Background(), "DELETE FROM smart_albums WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ------------------- Service -------------------
+
+// GetSmartAlbums Get every smart album, by name
+func (s *service) GetSmartAlbums() ([]*SmartAlbum, int, error) {
+	albums, err := s.ps.GetSmartAlbums()
+	if err != nil {
+		log.Println("could not get smart albums", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get smart albums")
+	}
+	return albums, http.StatusOK, nil
+}
+
+// GetSmartAlbumById Get the specified SmartAlbum from the database
+func (s *service) GetSmartAlbumById(id string) (*SmartAlbum, int, error) {
+	album, err := s.ps.GetSmartAlbumById(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("smart album does not exist")
+	}
+	if err != nil {
+		log.Println("could not get smart album. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get smart album")
+	}
+	return album, http.StatusOK, nil
+}
+
+// CreateSmartAlbum Save a new smart album
+func (s *service) CreateSmartAlbum(album *SmartAlbum) (int, error) {
+	err := album.normalize()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	id, err := database.GenSnowflake()
+	if err != nil {
+		log.Println("could not generate id", err)
+		return http.StatusInternalServerError, errors.New("could not generate id")
+	}
+	album.ID = id
+	album.CreatedAt = time.Now()
+	album.ModifiedAt = album.CreatedAt
+	err = s.ps.CreateSmartAlbum(album)
+	if err != nil {
+		log.Println("could not create smart album", err)
+		return http.StatusInternalServerError, errors.New("could not create smart album")
+	}
+	log.Println("created smart album. ID: " + album.ID)
+	return http.StatusCreated, nil
+}
+
+// EditSmartAlbum Change the name, description or query of a smart album
+func (s *service) EditSmartAlbum(edit *SmartAlbum) (*SmartAlbum, int, error) {
+	album, status, err := s.GetSmartAlbumById(edit.ID)
+	if err != nil {
+		return nil, status, err
+	}
+	err = edit.normalize()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	album.Name = edit.Name
+	album.Description = edit.Description
+	album.Query = edit.Query
+	album.ModifiedAt = time.Now()
+	err = s.ps.UpdateSmartAlbum(album)
+	if err != nil {
+		log.Println("could not update smart album. ID: "+album.ID, err)
+		return nil, http.StatusInternalServerError, errors.New("could not update smart album")
+	}
+	log.Println("edited smart album. ID: " + album.ID)
+	return album, http.StatusOK, nil
+}
+
+// DeleteSmartAlbum Delete a smart album, the photos it matches are left alone
+func (s *service) DeleteSmartAlbum(id string) (int, error) {
+	_, status, err := s.GetSmartAlbumById(id)
+	if err != nil {
+		return status, err
+	}
+	err = s.ps.DeleteSmartAlbum(id)
+	if err != nil {
+		log.Println("could not delete smart album. ID: "+id, err)
+		return http.StatusInternalServerError, errors.New("could not delete smart album")
+	}
+	log.Println("deleted smart album. ID: " + id)
+	return http.StatusNoContent, nil
+}
+
+// GetSmartAlbumPhotos Get a page of the photos that currently match a smart album's query.
+// The page is read from the query parameters, which can also override the saved sort.
+func (s *service) GetSmartAlbumPhotos(id string, values url.Values) (*PhotoPage, int, error) {
+	album, status, err := s.GetSmartAlbumById(id)
+	if err != nil {
+		return nil, status, err
+	}
+	q := album.Query
+	err = q.SetPage(values)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return s.SearchPhotos(&q)
+}
+
+// ------------------- Functions -------------------
+
+// normalize Tidy up the name and query of a smart album, and check that they're valid
+func (a *SmartAlbum) normalize() error {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		return errors.New("smart album needs a name")
+	}
+	a.Query.Text = strings.TrimSpace(a.Query.Text)
+	if a.Query.Sort == "" {
+		a.Query.Sort = SortTakenDesc
+		if a.Query.Text != "" {
+			a.Query.Sort = SortRelevance
+		}
+	}
+	return a.Query.Validate()
+}
+
+// ------------------- Handlers -------------------
+
+// GetSmartAlbums Get every smart album
+func GetSmartAlbums(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		albums, status, err := s.GetSmartAlbums()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, albums)
+	}
+}
+
+// CreateSmartAlbum Save a smart album from its name, description and query
+func CreateSmartAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album := SmartAlbum{}
+		err := json.NewDecoder(r.Body).Decode(&album)
+		if err != nil {
+			log.Println("Could not decode smart album", err)
+			responses.BadRequest(w, r, "Could not decode smart album")
+			return
+		}
+		status, err := s.CreateSmartAlbum(&album)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructCreated(w, r, album)
+	}
+}
+
+// GetSmartAlbum Get a smart album by the ID in the path
+func GetSmartAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, status, err := s.GetSmartAlbumById(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, album)
+	}
+}
+
+// UpdateSmartAlbum Change the name, description or query of a smart album
+func UpdateSmartAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		edit := SmartAlbum{}
+		err := json.NewDecoder(r.Body).Decode(&edit)
+		if err != nil {
+			log.Println("Could not decode smart album", err)
+			responses.BadRequest(w, r, "Could not decode smart album")
+			return
+		}
+		edit.ID = r.PathValue("id")
+		album, status, err := s.EditSmartAlbum(&edit)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, album)
+	}
+}
+
+// DeleteSmartAlbum Delete a smart album
+func DeleteSmartAlbum(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := s.DeleteSmartAlbum(r.PathValue("id"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.NoContent(w)
+	}
+}
+
+// GetSmartAlbumPhotos Get a page of the photos that match a smart album, paged like GetPhotosJSON
+func GetSmartAlbumPhotos(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, status, err := s.GetSmartAlbumPhotos(r.PathValue("id"), r.URL.Query())
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		page.SetLinks(r)
+		page.SetLinkHeader(w)
+		if WantsGeoJSON(r) {
+			responses.GeoJSON(w, r, NewFeatureCollection(page.Photos))
+			return
+		}
+		responses.StructOK(w, r, page)
+	}
+}
@@ -0,0 +1,224 @@
+package photodump
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// ------------------- Types -------------------
+
+// TimeSource Where the time a photo was taken came from
+type TimeSource string
+
+const (
+	// ExifTime The EXIF DateTimeOriginal tag
+	ExifTime TimeSource = "exif"
+	// IptcTime The IPTC DateCreated and TimeCreated tags
+	IptcTime TimeSource = "iptc"
+	// GpsTime The EXIF GPS date and time, which are always in UTC
+	GpsTime TimeSource = "gps"
+	// FilesystemTime The modification time of the uploaded file
+	FilesystemTime TimeSource = "filesystem"
+	// ManualTime Set by hand, so it's never overwritten by the metadata
+	ManualTime TimeSource = "manual"
+)
+
+// -------------- Globals --------------
+
+// defaultTimezone The zone that times without an offset are assumed to be in
+var defaultTimezone = func() *time.Location {
+	name := os.Getenv("PHOTO_DEFAULT_TIMEZONE")
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Println("Invalid PHOTO_DEFAULT_TIMEZONE, defaulting to UTC", err)
+		return time.UTC
+	}
+	return loc
+}()
+
+// ------------------- Functions -------------------
+
+// SetTakenAt Set the time the photo was taken, along with the offset it was taken in
+func (p *Photo) SetTakenAt(t time.Time, source TimeSource) {
+	_, offset := t.Zone()
+	p.TakenAt = t
+	p.TakenAtSource = source
+	p.TakenAtOffset = &offset
+}
+
+// LocalTakenAt The time the photo was taken, in the zone it was taken in if that's known
+func (p *Photo) LocalTakenAt() time.Time {
+	if p.TakenAtOffset == nil {
+		return p.TakenAt.In(defaultTimezone)
+	}
+	return p.TakenAt.In(time.FixedZone("", *p.TakenAtOffset))
+}
+
+// setTakenAtFromTags Work out when the photo was taken from its EXIF and IPTC tags.
+// Photos whose time was set by hand are left alone.
+func (p *Photo) setTakenAtFromTags(exif map[string]string, iptc map[string]string) {
+	if p.TakenAtSource == ManualTime {
+		return
+	}
+	gps, gpsOk := parseGPSTime(exif["Exif.GPSInfo.GPSDateStamp"], exif["Exif.GPSInfo.GPSTimeStamp"])
+
+	dt := exif["Exif.Image.DateTimeOriginal"]
+	if dt == "" {
+		dt = exif["Exif.Photo.DateTimeOriginal"]
+	}
+	if t, ok := parseExifTime(dt, exif["Exif.Photo.OffsetTimeOriginal"]); ok {
+		switch {
+		case exif["Exif.Photo.OffsetTimeOriginal"] != "":
+			p.SetTakenAt(t, ExifTime)
+		case gpsOk:
+			// The camera clock is in local time and the GPS clock is in UTC, so the difference is the offset
+			p.SetTakenAt(gps.In(zoneBetween(t, gps)), GpsTime)
+		default:
+			p.SetTakenAt(t, ExifTime)
+		}
+		return
+	}
+	if t, ok := parseIptcTime(iptc["Iptc.Application2.DateCreated"], iptc["Iptc.Application2.TimeCreated"]); ok {
+		p.SetTakenAt(t, IptcTime)
+		return
+	}
+	if gpsOk {
+		p.SetTakenAt(gps, GpsTime)
+	}
+}
+
+// fileModTime The modification time of an uploaded file.
+// Zip files without extended timestamps store local time, which Go reports as UTC.
+func fileModTime(t time.Time) time.Time {
+	if t.Location() != time.UTC {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, defaultTimezone)
+}
+
+// parseOffset Parse a UTC offset like "+02:00" into a fixed zone.
+// time.Parse would hand back the server's own zone when the offset matches it, so it's done by hand.
+func parseOffset(offset string) (*time.Location, bool) {
+	offset = strings.TrimSpace(offset)
+	if len(offset) != 6 || offset[3] != ':' {
+		return nil, false
+	}
+	sign := 1
+	switch offset[0] {
+	case '+':
+	case '-':
+		sign = -1
+	default:
+		return nil, false
+	}
+	hours, err := strconv.Atoi(offset[1:3])
+	if err != nil || hours > 14 {
+		return nil, false
+	}
+	minutes, err := strconv.Atoi(offset[4:6])
+	if err != nil || minutes > 59 {
+		return nil, false
+	}
+	return time.FixedZone("", sign*(hours*60*60+minutes*60)), true
+}
+
+// inFixedZone The same time in a fixed zone with its offset, rather than whichever named zone it was parsed in
+func inFixedZone(t time.Time) time.Time {
+	_, offset := t.Zone()
+	return t.In(time.FixedZone("", offset))
+}
+
+// zoneBetween The zone that the local time is in, given the same moment in UTC, to the nearest 15 minutes
+func zoneBetween(local time.Time, utc time.Time) *time.Location {
+	wall := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC)
+	offset := wall.Sub(utc).Round(15 * time.Minute)
+	if offset < -12*time.Hour || offset > 14*time.Hour {
+		return defaultTimezone
+	}
+	return time.FixedZone("", int(offset/time.Second))
+}
+
+// parseExifTime Parse an EXIF time like "2019:12:25 14:30:00" along with its offset,
+// falling back to the default zone when there isn't one
+func parseExifTime(dt string, offset string) (time.Time, bool) {
+	dt = strings.TrimSpace(dt)
+	if dt == "" {
+		return time.Time{}, false
+	}
+	loc, ok := parseOffset(offset)
+	if !ok {
+		loc = defaultTimezone
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", dt, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// parseGPSTime Parse an EXIF GPS date like "2019:12:25" and time like "14/1 30/1 0/1", which are in UTC
+func parseGPSTime(date string, stamp string) (time.Time, bool) {
+	day, err := time.Parse("2006:01:02", strings.TrimSpace(date))
+	if err != nil {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(stamp)
+	if len(fields) != 3 {
+		return time.Time{}, false
+	}
+	var seconds float64
+	for i, field := range fields {
+		f, ok := parseRational(field)
+		if !ok {
+			return time.Time{}, false
+		}
+		seconds += f * math.Pow(60, float64(2-i))
+	}
+	if seconds < 0 || seconds >= 24*60*60 {
+		return time.Time{}, false
+	}
+	return day.Add(time.Duration(seconds * float64(time.Second))), true
+}
+
+// parseIptcTime Parse an IPTC date like "2019-12-25" and time like "14:30:00+02:00"
+func parseIptcTime(date string, tm string) (time.Time, bool) {
+	date = strings.TrimSpace(date)
+	if date == "" {
+		return time.Time{}, false
+	}
+	if tm = strings.TrimSpace(tm); tm != "" {
+		t, err := time.Parse("2006-01-02 15:04:05-07:00", date+" "+tm)
+		if err == nil {
+			return inFixedZone(t), true
+		}
+	}
+	t, err := time.ParseInLocation(time.DateOnly, date, defaultTimezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ParseTime Parse a time given by hand, either RFC 3339 or a local time in the default zone
+func ParseTime(str string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, str)
+	if err == nil {
+		return inFixedZone(t), nil
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02T15:04", time.DateOnly} {
+		t, err = time.ParseInLocation(layout, str, defaultTimezone)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("expected an RFC 3339 time: " + str)
+}
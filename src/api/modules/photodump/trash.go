@@ -0,0 +1,367 @@
+package photodump
+
+import (
+	"context"
+	"errors"
+	"home_api/src/database"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/minio/minio-go/v7"
+)
+
+// -------------- Globals --------------
+
+// TrashPrefix Where the originals of trashed photos are kept in the photos bucket
+const TrashPrefix = "trash/"
+
+// TrashPurgeInterval How often the trash is checked for photos past the retention period
+const TrashPurgeInterval = time.Hour
+
+// TrashPurgeBatch The most photos purged from the trash in one go
+const TrashPurgeBatch = 100
+
+// trashRetention How long photos stay in the trash before they're purged, zero keeps them until they're purged by hand
+var trashRetention = func() time.Duration {
+	str := os.Getenv("PHOTO_TRASH_RETENTION_DAYS")
+	if str == "" {
+		return 30 * 24 * time.Hour
+	}
+	days, err := strconv.Atoi(str)
+	if err != nil || days < 0 {
+		log.Println("Invalid PHOTO_TRASH_RETENTION_DAYS, defaulting to 30 days")
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(days) * 24 * time.Hour
+}()
+
+// ------------------- Store -------------------
+
+const updatePhotoTrashQuery = `
+WITH updated AS (
+	UPDATE photos SET deleted_at = $2, file = $3, derivatives = $4, rendition = $5
+	WHERE id = $1 RETURNING id
+), cancelled AS (
+	DELETE FROM photo_outbox WHERE object = ANY($6::TEXT[]) AND EXISTS (SELECT 1 FROM updated)
+)
+INSERT INTO photo_outbox (object, photo_id, attempts, last_error, run_at, created_at)
+SELECT object, $1, 0, '', NOW(), NOW() FROM UNNEST($7::TEXT[]) AS object
+WHERE EXISTS (SELECT 1 FROM updated)
+ON CONFLICT (object) DO UPDATE SET attempts = 0, claimed = FALSE, last_error = '', run_at = EXCLUDED.run_at`
+
+// UpdatePhotoTrash Update only the fields that change when a Photo is trashed or restored in the database.
+// The objects it now refers to are taken out of the outbox, and the removed ones it no longer needs are queued.
+func (s *store) UpdatePhotoTrash(p *Photo, removed []string) error {
+	p.EnsureNonNil()
+	objects := photoObjects(p)
+	_, err := s.db.Exec(context.Background(), updatePhotoTrashQuery,
+		p.ID, p.DeletedAt, p.File, p.Derivatives, p.Rendition, objects, withoutObjects(removed, objects))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTrashedPhotos Get the photos in the trash, most recently deleted first
+func (s *store) GetTrashedPhotos() ([]*Photo, error) {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT "+photoColumns+" FROM photos WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+// GetExpiredTrash Get up to limit photos that were trashed before the given time, oldest first
+func (s *store) GetExpiredTrash(before time.Time, limit int) ([]*Photo, error) {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT "+photoColumns+" FROM photos WHERE deleted_at < $1 ORDER BY deleted_at LIMIT $2", before, limit)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Photo])
+	if err != nil {
+		return nil, err
+	}
+	for _, photo := range photos {
+		photo.EnsureNonNil()
+	}
+	return photos, nil
+}
+
+// CopyPhotoInS3 Copy the original of a photo between objects in the photos bucket, and point the photo at the copy
+func (s *store) CopyPhotoInS3(photo *Photo, from string, to string) error {
+	_, err := s.s3.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: "photos", Object: to},
+		minio.CopySrcOptions{Bucket: "photos", Object: from})
+	if err != nil {
+		return err
+	}
+	photo.File = database.S3_FILE_URI + "/photos/" + to
+	return nil
+}
+
+// DeleteObjectFromS3 Delete a single object from the photos bucket
+func (s *store) DeleteObjectFromS3(object string) error {
+	err := s.s3.RemoveObject(
+		context.Background(), "photos", object, minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ------------------- Service -------------------
+
+// trashPhoto Move a photo to the trash, hiding it everywhere until it's restored or purged.
+// The original is moved to the trash prefix, and the derivatives and rendition are deleted since they can be generated again.
+func (s *service) trashPhoto(photo *Photo) (int, error) {
+	old := *photo
+	status, err := s.movePhotoInS3(photo, photoObject(photo), TrashPrefix+photoObject(photo))
+	if err != nil {
+		return status, err
+	}
+	now := time.Now()
+	photo.DeletedAt = &now
+	photo.Derivatives = make([]Derivative, 0)
+	photo.Rendition = ""
+	err = s.ps.UpdatePhotoTrash(photo, photoObjects(&old))
+	if err != nil {
+		log.Println("could not move photo to the trash. ID: "+photo.ID, err)
+		return http.StatusInternalServerError, errors.New("could not move photo to the trash")
+	}
+	s.wakeOutbox()
+	log.Println("moved photo to the trash. ID: " + photo.ID)
+	return http.StatusNoContent, nil
+}
+
+// movePhotoInS3 Copy the original of a photo to where it's moving, the row update that follows queues the old one for deletion.
+// The copy is queued for deletion first, in case the row is never updated to refer to it.
+func (s *service) movePhotoInS3(photo *Photo, from string, to string) (int, error) {
+	err := s.ps.QueueObjectDeletions(photo.ID, []string{to}, time.Now().Add(OutboxUploadGrace))
+	if errors.Is(err, errDeletionClaimed) {
+		// Copying now would be undone by the deletion, which is usually the photo's last move being tidied up
+		log.Println("could not move photo, its destination is being deleted. ID: "+photo.ID+" Object: "+to, err)
+		return http.StatusConflict, errors.New("photo is still being moved, try again shortly")
+	}
+	if err != nil {
+		log.Println("could not queue moved photo in the outbox. ID: "+photo.ID, err)
+		return http.StatusInternalServerError, errors.New("could not move photo")
+	}
+	err = s.ps.CopyPhotoInS3(photo, from, to)
+	if err != nil {
+		log.Println("could not move photo in S3. ID: "+photo.ID+" Object: "+to, err)
+		return http.StatusInternalServerError, errors.New("could not move photo")
+	}
+	return http.StatusOK, nil
+}
+
+// getTrashedPhoto Get a photo from the database, only if it's in the trash
+func (s *service) getTrashedPhoto(id string) (*Photo, int, error) {
+	photo, err := s.ps.GetPhotoById(id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("photo does not exist")
+	}
+	if err != nil {
+		log.Println("could not get photo. ID: "+id, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get photo")
+	}
+	if photo.DeletedAt == nil {
+		return nil, http.StatusNotFound, errors.New("photo is not in the trash")
+	}
+	return photo, http.StatusOK, nil
+}
+
+// GetTrash Get the photos in the trash, most recently deleted first
+func (s *service) GetTrash() ([]*Photo, int, error) {
+	photos, err := s.ps.GetTrashedPhotos()
+	if err != nil {
+		log.Println("could not get trashed photos", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get trashed photos")
+	}
+	return photos, http.StatusOK, nil
+}
+
+// RestorePhoto Take a photo out of the trash, and regenerate its derivatives and rendition
+func (s *service) RestorePhoto(id string, actor string) (*Photo, int, error) {
+	photo, status, err := s.getTrashedPhoto(id)
+	if err != nil {
+		return nil, status, err
+	}
+	existing, status, err := s.GetPhotoByHash(photo.Hash)
+	if err == nil {
+		return nil, http.StatusConflict, &DuplicateError{
+			Message: "an identical image has been uploaded since this one was deleted", IDs: []string{existing.ID}}
+	}
+	if status != http.StatusNotFound {
+		return nil, status, err
+	}
+
+	trashed := photoObjects(photo)
+	status, err = s.movePhotoInS3(photo, TrashPrefix+photoObject(photo), photoObject(photo))
+	if err != nil {
+		return nil, status, err
+	}
+	photo.DeletedAt = nil
+	err = s.ps.UpdatePhotoTrash(photo, trashed)
+	if err != nil {
+		log.Println("could not restore photo. ID: "+photo.ID, err)
+		return nil, http.StatusInternalServerError, errors.New("could not restore photo")
+	}
+	s.wakeOutbox()
+	s.recordHistory(photo.ID, HistoryRestore, actor, nil)
+
+	kinds := []JobKind{DerivativesJob}
+	if NeedsRendition(photo.Ext) && renditionFormat != "none" {
+		kinds = append(kinds, RenditionJob)
+	}
+	for _, kind := range kinds {
+		_, _, err = s.QueuePhotoJob(photo.ID, kind)
+		if err != nil {
+			log.Println("could not queue job for restored photo. ID: "+photo.ID+" Kind: "+string(kind), err)
+		}
+	}
+	log.Println("restored photo from the trash. ID: " + photo.ID)
+	return photo, http.StatusOK, nil
+}
+
+// PurgePhoto Delete a photo in the trash for good if the confirmation string matches the hash
+func (s *service) PurgePhoto(id string, confirm string) (int, error) {
+	photo, status, err := s.getTrashedPhoto(id)
+	if err != nil {
+		return status, err
+	}
+	if photo.Hash != confirm {
+		return http.StatusBadRequest, errors.New("confirmation hash does not match photo hash")
+	}
+	return s.purgePhoto(photo)
+}
+
+// purgePhoto Delete a trashed photo from the database, leaving the outbox to delete it from S3
+func (s *service) purgePhoto(photo *Photo) (int, error) {
+	err := s.ps.DeletePhoto(photo)
+	if err != nil {
+		log.Println("could not delete photo. ID: "+photo.ID, err)
+		return http.StatusInternalServerError, errors.New("could not delete photo")
+	}
+	s.wakeOutbox()
+	log.Println("purged photo from the trash. ID: " + photo.ID)
+	return http.StatusNoContent, nil
+}
+
+// purgeExpiredTrash Purge the photos that have been in the trash for longer than the retention period
+func (s *service) purgeExpiredTrash() {
+	for {
+		photos, err := s.ps.GetExpiredTrash(time.Now().Add(-trashRetention), TrashPurgeBatch)
+		if err != nil {
+			log.Println("could not get expired trash", err)
+			return
+		}
+		for _, photo := range photos {
+			_, err = s.purgePhoto(photo)
+			if err != nil {
+				// Leave the rest for next time, rather than failing on the same photo forever
+				return
+			}
+		}
+		if len(photos) < TrashPurgeBatch {
+			return
+		}
+	}
+}
+
+// trashPurger Purge expired trash now and then until the context is cancelled
+func (s *service) trashPurger(ctx context.Context) {
+	if trashRetention == 0 {
+		return
+	}
+	ticker := time.NewTicker(TrashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		s.purgeExpiredTrash()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ------------------- Functions -------------------
+
+// photoObject The name of the original of a photo in the photos bucket
+func photoObject(photo *Photo) string {
+	return photo.ID + "." + photo.Ext
+}
+
+// ------------------- Handlers -------------------
+
+// GetTrash Get the photos in the trash
+func GetTrash(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		photos, status, err := s.GetTrash()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, photos)
+	}
+}
+
+// RestorePhoto Take the photo in the query out of the trash
+func RestorePhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			responses.BadRequest(w, r, "no ID in the query")
+			return
+		}
+		photo, status, err := s.RestorePhoto(id, requestActor(r))
+		var dupErr *DuplicateError
+		if errors.As(err, &dupErr) {
+			responses.ConflictProblem(dupErr.Message).
+				WithExtension("duplicates", dupErr.IDs).SendProblem(w, r)
+			return
+		}
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, photo)
+	}
+}
+
+// PurgePhoto Delete the photo in the query from the trash for good
+func PurgePhoto(s PhotoService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			responses.BadRequest(w, r, "no ID in the query")
+			return
+		}
+		confirm := r.URL.Query().Get("confirm")
+		if confirm == "" {
+			responses.BadRequest(w, r, "no confirm hash in the query")
+			return
+		}
+		status, err := s.PurgePhoto(id, confirm)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		log.Println("photo", id, "purged successfully")
+		responses.NoContent(w)
+	}
+}
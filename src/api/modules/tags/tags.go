@@ -0,0 +1,644 @@
+package tags
+
+import (
+	"context"
+	"errors"
+	"home_api/src/responses"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ------------------- Types -------------------
+
+// Tag A tag from the shared vocabulary, used by photos and wool.
+// Records store the tag's name, aliases are other names that resolve to it.
+type Tag struct {
+	Name        string    `json:"name" db:"name"`
+	Colour      string    `json:"colour" db:"colour"`
+	Description string    `json:"description" db:"description"`
+	Aliases     []string  `json:"aliases" db:"aliases"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	ModifiedAt  time.Time `json:"modified_at" db:"modified_at"`
+}
+
+// Retagger Something that stores tagged records, so renames, merges and deletes can be applied to it
+type Retagger interface {
+	// Retag Replace the tags in from with to on every record, removing them if to is empty.
+	// It must be safe to run again after a failure. Returns how many records were changed.
+	Retag(from []string, to string) (int64, error)
+}
+
+// RenameRequest The body of a rename
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// MergeRequest The body of a merge, the tags in From are folded into Into
+type MergeRequest struct {
+	From []string `json:"from"`
+	Into string   `json:"into"`
+}
+
+// -------------- Globals --------------
+
+// MaxTagLength The longest a tag name can be
+const MaxTagLength = 64
+
+// colourRegex Colours are hex RGB, like "#ff8800"
+var colourRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// unknownTags What happens to tags that aren't in the vocabulary, "reject" them or "create" them
+var unknownTags = func() string {
+	policy := os.Getenv("TAGS_UNKNOWN")
+	switch policy {
+	case "":
+		return "reject"
+	case "reject", "create":
+		return policy
+	}
+	log.Println("Invalid TAGS_UNKNOWN, defaulting to reject")
+	return "reject"
+}()
+
+// ------------------- Store -------------------
+
+// TagStore Interface for the tag store
+type TagStore interface {
+	GetTags() ([]*Tag, error)
+	GetTag(name string) (*Tag, error)
+	FindTags(names []string) ([]*Tag, error)
+	CreateTag(tag *Tag) error
+	UpdateTag(name string, tag *Tag) error
+	MergeTags(names []string, into *Tag) error
+	DeleteTags(names []string) error
+}
+
+// store Private implementation of TagStore
+type store struct {
+	db *pgxpool.Pool
+}
+
+// NewStore Creates a new TagStore
+func NewStore(db *pgxpool.Pool) TagStore {
+	return &store{db}
+}
+
+// GetTags Get every tag, by name
+func (s *store) GetTags() ([]*Tag, error) {
+	rows, err := s.db.Query(context.Background(), "SELECT * FROM tags ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Tag])
+}
+
+// GetTag Get the specified Tag from the database
+func (s *store) GetTag(name string) (*Tag, error) {
+	rows, _ := s.db.Query(context.Background(), "SELECT * FROM tags WHERE name = $1", name)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToAddrOfStructByName[Tag])
+}
+
+// FindTags Get the tags that have any of the names, either as their name or as an alias
+func (s *store) FindTags(names []string) ([]*Tag, error) {
+	rows, err := s.db.Query(context.Background(),
+		"SELECT * FROM tags WHERE name = ANY($1::TEXT[]) OR aliases && $1::TEXT[]", names)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Tag])
+}
+
+// CreateTag Add a Tag to the database
+func (s *store) CreateTag(t *Tag) error {
+	_, err := s.db.Exec(context.Background(), `
+INSERT INTO tags (name, colour, description, aliases, created_at, modified_at)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+		t.Name, t.Colour, t.Description, t.Aliases, t.CreatedAt, t.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateTag Update the Tag with the given name in the database, which may rename it
+func (s *store) UpdateTag(name string, t *Tag) error {
+	_, err := s.db.Exec(context.Background(), `
+UPDATE tags SET name = $2, colour = $3, description = $4, aliases = $5, modified_at = $6
+WHERE name = $1`,
+		name, t.Name, t.Colour, t.Description, t.Aliases, t.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// MergeTags Delete the merged tags and update the tag they were merged into, in one statement
+func (s *store) MergeTags(names []string, t *Tag) error {
+	_, err := s.db.Exec(context.Background(), `
+WITH merged AS (
+	DELETE FROM tags WHERE name = ANY($1::TEXT[]))
+UPDATE tags SET colour = $3, description = $4, aliases = $5, modified_at = $6
+WHERE name = $2`,
+		names, t.Name, t.Colour, t.Description, t.Aliases, t.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteTags Delete tags from the database, without touching the records tagged with them
+func (s *store) DeleteTags(names []string) error {
+	_, err := s.db.Exec(context.Background(), "DELETE FROM tags WHERE name = ANY($1::TEXT[])", names)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ------------------- Service -------------------
+
+// TagService Interface for the tag service
+type TagService interface {
+	GetTags() ([]*Tag, int, error)
+	GetTag(name string) (*Tag, int, error)
+	CreateTag(tag *Tag) (int, error)
+	EditTag(name string, tag *Tag) (*Tag, int, error)
+	RenameTag(name string, newName string) (*Tag, int, error)
+	MergeTags(from []string, into string) (*Tag, int, error)
+	DeleteTag(name string) (int, error)
+	NormalizeTags(names []string) ([]string, int, error)
+	ResolveTags(names []string) ([]string, []string, int, error)
+	AddRetagger(r Retagger)
+}
+
+// service Private TagService implementation
+type service struct {
+	ts        TagStore
+	retaggers []Retagger
+}
+
+// NewService Creates a new TagService
+func NewService(ts TagStore) TagService {
+	return &service{ts: ts}
+}
+
+// AddRetagger Apply renames, merges and deletes to the records in another store too
+func (s *service) AddRetagger(r Retagger) {
+	s.retaggers = append(s.retaggers, r)
+}
+
+// GetTags Get every tag, by name
+func (s *service) GetTags() ([]*Tag, int, error) {
+	tags, err := s.ts.GetTags()
+	if err != nil {
+		log.Println("could not get tags", err)
+		return nil, http.StatusInternalServerError, errors.New("could not get tags")
+	}
+	return tags, http.StatusOK, nil
+}
+
+// GetTag Get the specified Tag from the database
+func (s *service) GetTag(name string) (*Tag, int, error) {
+	tag, err := s.ts.GetTag(Normalize(name))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, http.StatusNotFound, errors.New("tag does not exist: " + name)
+	}
+	if err != nil {
+		log.Println("could not get tag. Name: "+name, err)
+		return nil, http.StatusInternalServerError, errors.New("could not get tag")
+	}
+	return tag, http.StatusOK, nil
+}
+
+// CreateTag Add a new tag to the vocabulary
+func (s *service) CreateTag(tag *Tag) (int, error) {
+	tag.Name = Normalize(tag.Name)
+	err := ValidateName(tag.Name)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	status, err := s.checkTag(tag, "")
+	if err != nil {
+		return status, err
+	}
+	tag.CreatedAt = time.Now()
+	tag.ModifiedAt = tag.CreatedAt
+	err = s.ts.CreateTag(tag)
+	if err != nil {
+		log.Println("could not create tag. Name: "+tag.Name, err)
+		return http.StatusInternalServerError, errors.New("could not create tag")
+	}
+	log.Println("created tag. Name: " + tag.Name)
+	return http.StatusCreated, nil
+}
+
+// EditTag Change the colour, description or aliases of a tag, use RenameTag to change its name
+func (s *service) EditTag(name string, edit *Tag) (*Tag, int, error) {
+	tag, status, err := s.GetTag(name)
+	if err != nil {
+		return nil, status, err
+	}
+	tag.Colour = edit.Colour
+	tag.Description = edit.Description
+	tag.Aliases = edit.Aliases
+	status, err = s.checkTag(tag, tag.Name)
+	if err != nil {
+		return nil, status, err
+	}
+	tag.ModifiedAt = time.Now()
+	err = s.ts.UpdateTag(tag.Name, tag)
+	if err != nil {
+		log.Println("could not update tag. Name: "+tag.Name, err)
+		return nil, http.StatusInternalServerError, errors.New("could not update tag")
+	}
+	log.Println("edited tag. Name: " + tag.Name)
+	return tag, http.StatusOK, nil
+}
+
+// RenameTag Rename a tag and every record tagged with it.
+// The old name is kept as an alias, so it still resolves to the tag.
+// Records are retagged first, retagging is safe to repeat, so a failed rename can just be retried.
+func (s *service) RenameTag(name string, newName string) (*Tag, int, error) {
+	tag, status, err := s.GetTag(name)
+	if err != nil {
+		return nil, status, err
+	}
+	newName = Normalize(newName)
+	err = ValidateName(newName)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if newName == tag.Name {
+		return tag, http.StatusOK, nil
+	}
+	oldName := tag.Name
+	tag.Name = newName
+	tag.Aliases = append(slices.DeleteFunc(tag.Aliases, func(alias string) bool {
+		return alias == newName
+	}), oldName)
+	status, err = s.checkTag(tag, oldName)
+	if err != nil {
+		return nil, status, err
+	}
+	status, err = s.retag([]string{oldName}, newName)
+	if err != nil {
+		return nil, status, err
+	}
+	tag.ModifiedAt = time.Now()
+	err = s.ts.UpdateTag(oldName, tag)
+	if err != nil {
+		log.Println("could not rename tag. Name: "+oldName, err)
+		return nil, http.StatusInternalServerError, errors.New("could not rename tag")
+	}
+	log.Println("renamed tag. Name: " + oldName + " New name: " + newName)
+	return tag, http.StatusOK, nil
+}
+
+// MergeTags Fold tags into another tag, retagging every record tagged with them.
+// The merged tags' names and aliases become aliases of the tag they were merged into.
+// Like renames, records are retagged first so a failed merge can be retried.
+func (s *service) MergeTags(from []string, into string) (*Tag, int, error) {
+	if len(from) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no tags to merge")
+	}
+	tag, status, err := s.GetTag(into)
+	if err != nil {
+		return nil, status, err
+	}
+	names := make([]string, 0, len(from))
+	for _, name := range from {
+		merged, status, err := s.GetTag(name)
+		if err != nil {
+			return nil, status, err
+		}
+		if merged.Name == tag.Name {
+			return nil, http.StatusBadRequest, errors.New("can't merge a tag into itself: " + tag.Name)
+		}
+		if !slices.Contains(names, merged.Name) {
+			names = append(names, merged.Name)
+			tag.Aliases = append(tag.Aliases, merged.Name)
+			tag.Aliases = append(tag.Aliases, merged.Aliases...)
+		}
+	}
+	tag.Aliases = normalizeList(tag.Aliases)
+
+	status, err = s.retag(names, tag.Name)
+	if err != nil {
+		return nil, status, err
+	}
+	tag.ModifiedAt = time.Now()
+	err = s.ts.MergeTags(names, tag)
+	if err != nil {
+		log.Println("could not merge tags. Into: "+tag.Name, err)
+		return nil, http.StatusInternalServerError, errors.New("could not merge tags")
+	}
+	log.Println("merged tags. From: " + strings.Join(names, ", ") + " Into: " + tag.Name)
+	return tag, http.StatusOK, nil
+}
+
+// DeleteTag Delete a tag, removing it from every record tagged with it.
+// Records are untagged first so a failed delete can be retried.
+func (s *service) DeleteTag(name string) (int, error) {
+	tag, status, err := s.GetTag(name)
+	if err != nil {
+		return status, err
+	}
+	status, err = s.retag([]string{tag.Name}, "")
+	if err != nil {
+		return status, err
+	}
+	err = s.ts.DeleteTags([]string{tag.Name})
+	if err != nil {
+		log.Println("could not delete tag. Name: "+tag.Name, err)
+		return http.StatusInternalServerError, errors.New("could not delete tag")
+	}
+	log.Println("deleted tag. Name: " + tag.Name)
+	return http.StatusNoContent, nil
+}
+
+// NormalizeTags Resolve tags given on input to the names in the vocabulary, following aliases and dropping repeats.
+// Unknown tags are rejected, or created if TAGS_UNKNOWN is "create".
+func (s *service) NormalizeTags(names []string) ([]string, int, error) {
+	tags, unknown, err := s.resolveTags(names)
+	if err != nil {
+		log.Println("could not find tags", err)
+		return nil, http.StatusInternalServerError, errors.New("could not check tags")
+	}
+	if len(unknown) == 0 {
+		return tags, http.StatusOK, nil
+	}
+	if unknownTags != "create" {
+		return nil, http.StatusBadRequest, errors.New("unknown tags: " + strings.Join(unknown, ", "))
+	}
+	for _, name := range unknown {
+		status, err := s.CreateTag(&Tag{Name: name})
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	return tags, http.StatusOK, nil
+}
+
+// ResolveTags Resolve tags to the names in the vocabulary like NormalizeTags, without rejecting or creating unknown tags.
+// Returns the resolved tags, with unknown tags kept as they are, and the unknown tags, for the caller to deal with.
+func (s *service) ResolveTags(names []string) ([]string, []string, int, error) {
+	tags, unknown, err := s.resolveTags(names)
+	if err != nil {
+		log.Println("could not find tags", err)
+		return nil, nil, http.StatusInternalServerError, errors.New("could not check tags")
+	}
+	return tags, unknown, http.StatusOK, nil
+}
+
+// resolveTags Normalize tags and follow their aliases, dropping repeats.
+// Returns the resolved tags, with unknown tags kept as they are, and the unknown tags.
+func (s *service) resolveTags(names []string) ([]string, []string, error) {
+	names = normalizeList(names)
+	if len(names) == 0 {
+		return names, nil, nil
+	}
+	found, err := s.ts.FindTags(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolved := make(map[string]string)
+	for _, tag := range found {
+		resolved[tag.Name] = tag.Name
+		for _, alias := range tag.Aliases {
+			if _, ok := resolved[alias]; !ok {
+				resolved[alias] = tag.Name
+			}
+		}
+	}
+
+	var unknown []string
+	tags := make([]string, 0, len(names))
+	for _, name := range names {
+		tag, ok := resolved[name]
+		if !ok {
+			unknown = append(unknown, name)
+			tag = name
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, unknown, nil
+}
+
+// checkTag Check a tag's colour and aliases, and that none of its names are used by another tag.
+// current is the tag's name before the change, or empty for a new tag.
+func (s *service) checkTag(tag *Tag, current string) (int, error) {
+	if tag.Colour != "" && !colourRegex.MatchString(tag.Colour) {
+		return http.StatusBadRequest, errors.New("colour must be hex RGB, like #ff8800")
+	}
+	tag.Colour = strings.ToLower(tag.Colour)
+	tag.Aliases = normalizeList(tag.Aliases)
+	for _, alias := range tag.Aliases {
+		err := ValidateName(alias)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	tag.Aliases = slices.DeleteFunc(tag.Aliases, func(alias string) bool {
+		return alias == tag.Name
+	})
+
+	others, err := s.ts.FindTags(append([]string{tag.Name}, tag.Aliases...))
+	if err != nil {
+		log.Println("could not find tags", err)
+		return http.StatusInternalServerError, errors.New("could not check tags")
+	}
+	for _, other := range others {
+		if other.Name != current {
+			return http.StatusConflict, errors.New("a name or alias is already used by the tag: " + other.Name)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// retag Apply a rename, merge or delete to every store of tagged records
+func (s *service) retag(from []string, to string) (int, error) {
+	for _, r := range s.retaggers {
+		changed, err := r.Retag(from, to)
+		if err != nil {
+			log.Println("could not retag records. From: "+strings.Join(from, ", ")+" To: "+to, err)
+			return http.StatusInternalServerError, errors.New("could not retag records")
+		}
+		log.Println("retagged", changed, "records. From: "+strings.Join(from, ", ")+" To: "+to)
+	}
+	return http.StatusOK, nil
+}
+
+// ------------------- Functions -------------------
+
+// Normalize The form tag names are stored in, trimmed and lower case
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// ValidateName Check a normalized tag name can be stored, and given in a comma separated list
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("tag names can't be empty")
+	}
+	if len(name) > MaxTagLength {
+		return errors.New("tag names can't be longer than " + strconv.Itoa(MaxTagLength) + " bytes: " + name)
+	}
+	if strings.Contains(name, ",") {
+		return errors.New("tag names can't contain commas: " + name)
+	}
+	return nil
+}
+
+// normalizeList Normalize a list of tag names, dropping empty names and repeats
+func normalizeList(names []string) []string {
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		name = Normalize(name)
+		if name != "" && !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// Replace Apply a retag to a list of tags, keeping the order and dropping repeats
+func Replace(tags []string, from []string, to string) ([]string, bool) {
+	replaced := make([]string, 0, len(tags))
+	changed := false
+	for _, tag := range tags {
+		if slices.Contains(from, tag) {
+			changed = true
+			tag = to
+		}
+		if tag != "" && !slices.Contains(replaced, tag) {
+			replaced = append(replaced, tag)
+		}
+	}
+	return replaced, changed
+}
+
+// ------------------- Handlers -------------------
+
+// GetTags Get every tag
+func GetTags(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tags, status, err := s.GetTags()
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, tags)
+	}
+}
+
+// GetTag Get a tag by the name in the path
+func GetTag(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag, status, err := s.GetTag(r.PathValue("name"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, tag)
+	}
+}
+
+// CreateTag Add a tag to the vocabulary
+func CreateTag(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag := Tag{}
+		err := json.NewDecoder(r.Body).Decode(&tag)
+		if err != nil {
+			log.Println("Could not decode tag", err)
+			responses.BadRequest(w, r, "Could not decode tag")
+			return
+		}
+		status, err := s.CreateTag(&tag)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructCreated(w, r, tag)
+	}
+}
+
+// UpdateTag Change the colour, description or aliases of a tag
+func UpdateTag(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		edit := Tag{}
+		err := json.NewDecoder(r.Body).Decode(&edit)
+		if err != nil {
+			log.Println("Could not decode tag", err)
+			responses.BadRequest(w, r, "Could not decode tag")
+			return
+		}
+		tag, status, err := s.EditTag(r.PathValue("name"), &edit)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, tag)
+	}
+}
+
+// RenameTag Rename a tag to {"name": "..."}, along with every record tagged with it
+func RenameTag(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rename := RenameRequest{}
+		err := json.NewDecoder(r.Body).Decode(&rename)
+		if err != nil {
+			log.Println("Could not decode rename", err)
+			responses.BadRequest(w, r, "Could not decode rename")
+			return
+		}
+		tag, status, err := s.RenameTag(r.PathValue("name"), rename.Name)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, tag)
+	}
+}
+
+// MergeTags Merge {"from": [...]} into {"into": "..."}, along with every record tagged with them
+func MergeTags(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merge := MergeRequest{}
+		err := json.NewDecoder(r.Body).Decode(&merge)
+		if err != nil {
+			log.Println("Could not decode merge", err)
+			responses.BadRequest(w, r, "Could not decode merge")
+			return
+		}
+		tag, status, err := s.MergeTags(merge.From, merge.Into)
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.StructOK(w, r, tag)
+	}
+}
+
+// DeleteTag Delete a tag, removing it from every record tagged with it
+func DeleteTag(s TagService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := s.DeleteTag(r.PathValue("name"))
+		if err != nil {
+			responses.SwitchCase(w, r, status, err.Error())
+			return
+		}
+		responses.NoContent(w)
+	}
+}
@@ -2,6 +2,7 @@ package woolcatalogue
 
 import (
 	"errors"
+	"home_api/src/api/modules/tags"
 	"home_api/src/database"
 	"home_api/src/responses"
 	"log"
@@ -15,35 +16,20 @@ import (
 
 // ------------------- Types -------------------
 
-type Tags string
-
-const (
-	Sparkly   Tags = "sparkly"
-	Christmas Tags = "christmas"
-)
-
 // Wool - Struct for wool
 type Wool struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Brand       string `json:"brand,omitempty"`
-	Length      string `json:"length,omitempty"`
-	Weight      string `json:"weight,omitempty"`
-	Ply         int    `json:"ply,omitempty"`
-	NeedleSize  string `json:"needle_size,omitempty"`
-	Colour      string `json:"colour,omitempty"`
-	Composition string `json:"composition,omitempty"`
-	Quantity    int    `json:"quantity,omitempty"`
-	Partial     int    `json:"partial,omitempty"`
-	Tags        []Tags `json:"tags,omitempty"`
-}
-
-func (w Wool) TagsString() []string {
-	var tags []string
-	for _, tag := range w.Tags {
-		tags = append(tags, string(tag))
-	}
-	return tags
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Brand       string   `json:"brand,omitempty"`
+	Length      string   `json:"length,omitempty"`
+	Weight      string   `json:"weight,omitempty"`
+	Ply         int      `json:"ply,omitempty"`
+	NeedleSize  string   `json:"needle_size,omitempty"`
+	Colour      string   `json:"colour,omitempty"`
+	Composition string   `json:"composition,omitempty"`
+	Quantity    int      `json:"quantity,omitempty"`
+	Partial     int      `json:"partial,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 // ------------------- Store -------------------
@@ -58,9 +44,11 @@ type WoolStore interface {
 
 type store struct {
 	wools []Wool
+	tags  tags.TagService
 }
 
-func Load() (*store, error) {
+// Load - Load the wool from disk, checking wool tags against the shared tag vocabulary
+func Load(ts tags.TagService) (*store, error) {
 	// Hardcoded filename for now
 	filename := "./data/wool-catalogue.json"
 	file, err := os.ReadFile(filename)
@@ -74,6 +62,7 @@ func Load() (*store, error) {
 	}
 	return &store{
 		wools: wools,
+		tags:  ts,
 	}, nil
 }
 
@@ -115,6 +104,22 @@ func (s *store) UpdateWool(wool *Wool) error {
 	return errors.New("wool not found")
 }
 
+// Retag - Replace tags on every wool, removing them if to is empty
+func (s *store) Retag(from []string, to string) (int64, error) {
+	var changed int64
+	for i, wool := range s.wools {
+		replaced, ok := tags.Replace(wool.Tags, from, to)
+		if ok {
+			s.wools[i].Tags = replaced
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, s.save()
+}
+
 func (s *store) DeleteWool(id string) error {
 	for i, wool := range s.wools {
 		if wool.ID == id {
@@ -189,10 +194,7 @@ func CreateWoolFromFormData(r *http.Request) (*Wool, error, int) {
 		wool.Partial = partialInt
 	}
 	if tags := r.Form.Get("tags"); tags != "" {
-		tags := strings.Split(tags, ",")
-		for _, tag := range tags {
-			wool.Tags = append(wool.Tags, Tags(tag))
-		}
+		wool.Tags = strings.Split(tags, ",")
 	}
 	return &wool, nil, http.StatusOK
 }
@@ -234,6 +236,11 @@ func CreateWool(s *store) http.HandlerFunc {
 				return
 			}
 		}
+		wool.Tags, code, err = s.tags.NormalizeTags(wool.Tags)
+		if err != nil {
+			responses.SwitchCase(w, r, code, err.Error())
+			return
+		}
 		err = s.CreateWool(wool)
 		if err != nil {
 			log.Println("Could not create wool", err)
@@ -275,6 +282,12 @@ func UpdateWool(s *store) http.HandlerFunc {
 			responses.BadRequest(w, r, "Could not decode wool")
 			return
 		}
+		woolTags, code, err := s.tags.NormalizeTags(wool.Tags)
+		if err != nil {
+			responses.SwitchCase(w, r, code, err.Error())
+			return
+		}
+		wool.Tags = woolTags
 		err = s.UpdateWool(&wool)
 		if err != nil {
 			log.Println("Could not update wool", err)
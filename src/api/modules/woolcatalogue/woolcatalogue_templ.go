@@ -122,7 +122,7 @@ func WoolCard(wool Wool) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</div><!-- <div>Quantity: {strconv.Itoa(wool.Quantity)}</div> --><!-- <div>Partial: {strconv.Itoa(wool.Partial)}</div> --><!-- <div>Tags: {strings.Join(wool.TagsString(), \", \")}</div> --><br><br><br><br><br><br><br><br>")
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString("</div><!-- <div>Quantity: {strconv.Itoa(wool.Quantity)}</div> --><!-- <div>Partial: {strconv.Itoa(wool.Partial)}</div> --><!-- <div>Tags: {strings.Join(wool.Tags, \", \")}</div> --><br><br><br><br><br><br><br><br>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
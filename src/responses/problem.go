@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"home_api/src/proto/problempb"
 	"net/http"
+	"strconv"
 
 	"github.com/goccy/go-json"
 	"google.golang.org/protobuf/proto"
@@ -14,12 +15,14 @@ import (
 // problem -- Defined by https://www.rfc-editor.org/rfc/rfc9457.html#section-3
 type problem struct {
 	*problempb.Problem
+	// Extensions -- Extension members, see https://www.rfc-editor.org/rfc/rfc9457.html#section-3.2
+	Extensions map[string]any `json:"-" xml:"-"`
 }
 
 // NewProblem -- Create a new Problem
 func NewProblem(Type string, Status int, Title string, Detail string, Instance string) *problem {
 	return &problem{
-		&problempb.Problem{
+		Problem: &problempb.Problem{
 			Type:     Type,
 			Status:   int32(Status),
 			Title:    Title,
@@ -29,6 +32,46 @@ func NewProblem(Type string, Status int, Title string, Detail string, Instance s
 	}
 }
 
+// NewStatusProblem -- Create a new Problem for an HTTP status code
+func NewStatusProblem(Status int, Detail string) *problem {
+	return NewProblem(
+		"about:blank",
+		Status,
+		http.StatusText(Status),
+		Detail,
+		"https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/"+strconv.Itoa(Status),
+	)
+}
+
+// WithExtension -- Add an extension member to the Problem
+func (problem *problem) WithExtension(key string, value any) *problem {
+	if problem.Extensions == nil {
+		problem.Extensions = make(map[string]any)
+	}
+	problem.Extensions[key] = value
+	return problem
+}
+
+// MarshalJSON -- Marshal the Problem with its extension members alongside the standard ones
+func (problem *problem) MarshalJSON() ([]byte, error) {
+	structBytes, err := json.Marshal(problem.Problem)
+	if err != nil || len(problem.Extensions) == 0 {
+		return structBytes, err
+	}
+	members := make(map[string]any)
+	err = json.Unmarshal(structBytes, &members)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range problem.Extensions {
+		// Extensions can't override the standard members
+		if _, ok := members[key]; !ok {
+			members[key] = value
+		}
+	}
+	return json.Marshal(members)
+}
+
 // SendProblem -- Send a Problem as JSON, XML or Protobuf
 func (problem *problem) SendProblem(w http.ResponseWriter, r *http.Request) {
 	var content string = "application/problem+"
@@ -66,7 +109,11 @@ func SwitchCase(w http.ResponseWriter, r *http.Request, statusCode int, message
 		Forbidden(w, r, message)
 	case http.StatusNotFound:
 		NotFound(w, r, message)
+	case http.StatusConflict:
+		Conflict(w, r, message)
 	case http.StatusInternalServerError:
 		InternalServerError(w, r, message)
+	default:
+		NewStatusProblem(statusCode, message).SendProblem(w, r)
 	}
 }
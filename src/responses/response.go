@@ -119,6 +119,22 @@ func StructCreated[T any](w http.ResponseWriter, r *http.Request, data T) {
 	SendStruct(w, r, http.StatusCreated, data)
 }
 
+// GeoJSON Send a struct as GeoJSON, see https://datatracker.ietf.org/doc/html/rfc7946
+func GeoJSON[T any](w http.ResponseWriter, r *http.Request, data T) {
+	structBytes, err := json.Marshal(data)
+	if err != nil {
+		log.Println(err)
+		InternalServerError(w, r, "Could not encode GeoJSON")
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(structBytes)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 // NoContent Send a no content response
 func NoContent(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNoContent)
@@ -180,6 +196,25 @@ func NotFound(w http.ResponseWriter, r *http.Request, message string) {
 	).SendProblem(w, r)
 }
 
+// Conflict Send a ConflictResponse as JSON or XML
+func Conflict(w http.ResponseWriter, r *http.Request, message string) {
+	ConflictProblem(message).SendProblem(w, r)
+}
+
+// ConflictProblem Create a conflict problem, so extension members can be added before sending it
+func ConflictProblem(message string) *problem {
+	if message == "" {
+		message = "The request conflicts with the current state of the resource."
+	}
+	return NewProblem(
+		"about:blank",
+		http.StatusConflict,
+		"Conflict",
+		message,
+		"https://developer.mozilla.org/en-US/docs/Web/HTTP/Status/409",
+	)
+}
+
 // InternalServerError -- Send an InternalServerErrorResponse as JSON or XML
 func InternalServerError(w http.ResponseWriter, r *http.Request, message string) {
 	if message == "" {
@@ -1,8 +1,11 @@
 package routes
 
 import (
+	"context"
 	"embed"
+	"home_api/src/api/modules/familytree"
 	"home_api/src/api/modules/photodump"
+	"home_api/src/api/modules/tags"
 	"home_api/src/database"
 	"home_api/src/web/components"
 	"net/http"
@@ -25,9 +28,14 @@ func CreateStack(routers ...Router) Router {
 func ApplyRoutes(mux *http.ServeMux, public embed.FS) *http.ServeMux {
 	mux.Handle("/public/", http.FileServer(http.FS(public)))
 
+	ts := tags.NewService(tags.NewStore(database.GetDB("home")))
+	fs := familytree.NewStore(database.GetDB("home"))
+
 	Home(mux)
-	PhotoDump(mux)
-	WoolCatalogue(mux)
+	Tags(mux, ts)
+	FamilyTree(mux, fs)
+	PhotoDump(mux, ts, fs)
+	WoolCatalogue(mux, ts)
 	return mux
 }
 
@@ -36,26 +44,93 @@ func Home(mux *http.ServeMux) *http.ServeMux {
 	return mux
 }
 
-func PhotoDump(mux *http.ServeMux) *http.ServeMux {
-	s := photodump.NewService(photodump.NewStore(
-		database.GetDB("home"), database.GetS3()))
+func Tags(mux *http.ServeMux, ts tags.TagService) *http.ServeMux {
+	mux.Handle("GET /api/v1/tags", tags.GetTags(ts))
+	mux.Handle("POST /api/v1/tags", tags.CreateTag(ts))
+	mux.Handle("POST /api/v1/tags/merge", tags.MergeTags(ts))
+	mux.Handle("GET /api/v1/tags/{name}", tags.GetTag(ts))
+	mux.Handle("PUT /api/v1/tags/{name}", tags.UpdateTag(ts))
+	mux.Handle("DELETE /api/v1/tags/{name}", tags.DeleteTag(ts))
+	mux.Handle("POST /api/v1/tags/{name}/rename", tags.RenameTag(ts))
+	return mux
+}
 
-	mux.Handle("GET /photo-dump", templ.Handler(components.PhotoDumpRoot(database.S3_FILE_URI+"/cdn/htmx-v2.0.3.js")))
+func FamilyTree(mux *http.ServeMux, fs *familytree.Store) *http.ServeMux {
+	personRoot := func(person *familytree.Person) templ.Component {
+		return components.PersonRoot(database.S3_FILE_URI+"/cdn/htmx-v2.0.3.js", person)
+	}
+
+	mux.Handle("GET /family-tree/people/{id}", familytree.GetPersonHTML(fs, personRoot))
+	mux.Handle("GET /api/v1/family-tree/people/{id}", familytree.GetPerson(fs))
+	return mux
+}
+
+func PhotoDump(mux *http.ServeMux, ts tags.TagService, fs *familytree.Store) *http.ServeMux {
+	ps := photodump.NewStore(database.GetDB("home"), database.GetS3())
+	ts.AddRetagger(ps)
+	s := photodump.NewService(ps, ts, fs)
+	s.RunJobs(context.Background())
+
+	htmxSrc := database.S3_FILE_URI + "/cdn/htmx-v2.0.3.js"
+	albumsRoot := func(page *photodump.AlbumsPage) templ.Component {
+		return components.AlbumsRoot(htmxSrc, page)
+	}
+
+	mux.Handle("GET /photo-dump", templ.Handler(components.PhotoDumpRoot(htmxSrc)))
 	mux.Handle("GET /photo-dump/photos", photodump.GetPhotosHTML(s, components.Photos))
+	mux.Handle("GET /photo-dump/albums", photodump.GetAlbumsHTML(s, albumsRoot))
+	mux.Handle("GET /photo-dump/albums/{id}", photodump.GetAlbumsHTML(s, albumsRoot))
+	mux.Handle("GET /photo-dump/albums/{id}/view", photodump.GetAlbumHTML(s, components.Album))
 
 	mux.Handle("GET /api/v1/photo-dump/photo", photodump.GetPhoto(s))
+	mux.Handle("HEAD /api/v1/photo-dump/photo", photodump.HasPhoto(s))
 	mux.Handle("POST /api/v1/photo-dump/photo", photodump.UploadPhoto(s))
 	mux.Handle("PUT /api/v1/photo-dump/photo", photodump.UpdatePhoto(s))
+	mux.Handle("PATCH /api/v1/photo-dump/photo/{id}", photodump.PatchPhoto(s))
+	mux.Handle("GET /api/v1/photo-dump/photo/{id}/download", photodump.DownloadPhoto(s))
+	mux.Handle("GET /api/v1/photo-dump/photo/{id}/history", photodump.GetPhotoHistory(s))
+	mux.Handle("POST /api/v1/photo-dump/photo/{id}/history/{entry}/revert", photodump.RevertPhoto(s))
 	mux.Handle("DELETE /api/v1/photo-dump/photo", photodump.DeletePhoto(s))
+	mux.Handle("GET /api/v1/photo-dump/photo/jobs", photodump.GetPhotoJobs(s))
+	mux.Handle("POST /api/v1/photo-dump/photo/jobs", photodump.QueuePhotoJob(s))
+	mux.Handle("PUT /api/v1/photo-dump/photo/regions", photodump.SetPhotoRegions(s))
+	mux.Handle("GET /api/v1/photo-dump/trash", photodump.GetTrash(s))
+	mux.Handle("POST /api/v1/photo-dump/trash/restore", photodump.RestorePhoto(s))
+	mux.Handle("DELETE /api/v1/photo-dump/trash", photodump.PurgePhoto(s))
 	mux.Handle("GET /api/v1/photo-dump/photos", photodump.GetPhotosJSON(s))
+	mux.Handle("GET /api/v1/photo-dump/photos/similar", photodump.GetSimilarPhotos(s))
+	mux.Handle("POST /api/v1/photo-dump/photos/similar", photodump.GetSimilarPhotos(s))
+	mux.Handle("GET /api/v1/photo-dump/photos/near", photodump.GetPhotosNear(s))
+	mux.Handle("GET /api/v1/photo-dump/photos/bbox", photodump.GetPhotosInBox(s))
+	mux.Handle("GET /api/v1/photo-dump/cameras", photodump.GetCameras(s))
+	mux.Handle("GET /api/v1/photo-dump/people/{id}/photos", photodump.GetPersonPhotos(s))
+
+	mux.Handle("GET /api/v1/photo-dump/albums", photodump.GetAlbums(s))
+	mux.Handle("POST /api/v1/photo-dump/albums", photodump.CreateAlbum(s))
+	mux.Handle("PUT /api/v1/photo-dump/albums/order", photodump.ReorderAlbums(s))
+	mux.Handle("GET /api/v1/photo-dump/albums/{id}", photodump.GetAlbum(s))
+	mux.Handle("PUT /api/v1/photo-dump/albums/{id}", photodump.UpdateAlbum(s))
+	mux.Handle("DELETE /api/v1/photo-dump/albums/{id}", photodump.DeleteAlbum(s))
+	mux.Handle("GET /api/v1/photo-dump/albums/{id}/photos", photodump.GetAlbumPhotos(s))
+	mux.Handle("POST /api/v1/photo-dump/albums/{id}/photos", photodump.AddAlbumPhotos(s))
+	mux.Handle("PUT /api/v1/photo-dump/albums/{id}/photos/order", photodump.ReorderAlbumPhotos(s))
+	mux.Handle("DELETE /api/v1/photo-dump/albums/{id}/photos/{photo_id}", photodump.RemoveAlbumPhoto(s))
+
+	mux.Handle("GET /api/v1/photo-dump/smart-albums", photodump.GetSmartAlbums(s))
+	mux.Handle("POST /api/v1/photo-dump/smart-albums", photodump.CreateSmartAlbum(s))
+	mux.Handle("GET /api/v1/photo-dump/smart-albums/{id}", photodump.GetSmartAlbum(s))
+	mux.Handle("PUT /api/v1/photo-dump/smart-albums/{id}", photodump.UpdateSmartAlbum(s))
+	mux.Handle("DELETE /api/v1/photo-dump/smart-albums/{id}", photodump.DeleteSmartAlbum(s))
+	mux.Handle("GET /api/v1/photo-dump/smart-albums/{id}/photos", photodump.GetSmartAlbumPhotos(s))
 	return mux
 }
 
-func WoolCatalogue(mux *http.ServeMux) *http.ServeMux {
-	// store, err := woolcatalogue.Load()
+func WoolCatalogue(mux *http.ServeMux, ts tags.TagService) *http.ServeMux {
+	// store, err := woolcatalogue.Load(ts)
 	// if err != nil {
 	// 	panic(err)
 	// }
+	// ts.AddRetagger(store)
 	// mux.Handle("GET /wool-catalogue", templ.Handler(components.WoolRoot(database.S3_FILE_URI + "/cdn/htmx-v2.0.3.js"))
 	//
 	// mux.Handle("GET /api/v1/wool-catalogue/wool", woolcatalogue.GetWool(store))